@@ -0,0 +1,629 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/errgroup"
+)
+
+// getManyBytes is a batch version of getBytes. The returned slices are
+// aligned with keys: errs[i] is nil on a hit, ErrCacheMiss on a miss, the
+// checkKey error for an invalid key, or the Redis error.
+func (cd *Cache) getManyBytes(ctx context.Context, keys []string) ([][]byte, []error) {
+	values, errs := cd.lookupManyBytes(ctx, keys)
+	if cd.opt.ReadTransform == nil {
+		return values, errs
+	}
+
+	for i, key := range keys {
+		if errs[i] == nil {
+			values[i], errs[i] = cd.readTransform(ctx, key, values[i], true)
+		}
+	}
+	return values, errs
+}
+
+// lookupManyBytes is a batch version of lookupBytes.
+func (cd *Cache) lookupManyBytes(ctx context.Context, keys []string) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	if len(cd.shards) == 0 && cd.opt.LocalCache == nil {
+		for i := range errs {
+			errs[i] = ErrNoBackend
+		}
+		return values, errs
+	}
+
+	bypass := bypassed(ctx)
+	var remaining []string
+	var remainingIdxs []int
+	for i, key := range keys {
+		if err := cd.checkKey(key); err != nil {
+			errs[i] = err
+			continue
+		}
+		if bypass {
+			errs[i] = ErrCacheMiss
+			continue
+		}
+		if cd.opt.LocalCache != nil && !cd.redisFirst(key) {
+			if b, ok := cd.opt.LocalCache.Get(key); ok {
+				values[i] = b
+				continue
+			}
+		}
+		remaining = append(remaining, key)
+		remainingIdxs = append(remainingIdxs, i)
+	}
+
+	if len(remaining) == 0 {
+		return values, errs
+	}
+
+	if len(cd.shards) == 0 {
+		for j, key := range remaining {
+			cd.onMiss(key)
+			errs[remainingIdxs[j]] = ErrCacheMiss
+		}
+		return values, errs
+	}
+
+	readCtx := ctx
+	if cd.opt.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, cd.opt.ReadTimeout)
+		defer cancel()
+	}
+
+	fetched, fetchErrs := cd.redisGetMany(readCtx, remaining)
+	var backfillKeys []string
+	var backfillValues [][]byte
+	for j, key := range remaining {
+		i := remainingIdxs[j]
+
+		if err := fetchErrs[j]; err != nil {
+			cd.countReadError(ctx, err)
+			if err == redis.Nil {
+				cd.onMiss(key)
+				err = ErrCacheMiss
+			} else if cd.opt.LocalCache != nil && cd.redisFirst(key) {
+				if b, ok := cd.opt.LocalCache.Get(key); ok {
+					cd.onError(fmt.Errorf("cache: serving local value for key=%q: %w", key, err))
+					values[i] = b
+					continue
+				}
+			}
+			errs[i] = err
+			continue
+		}
+
+		if cd.statsEnabled(ctx) {
+			atomic.AddUint64(&cd.hits, 1)
+		}
+
+		b := fetched[j]
+		if cd.opt.LocalCache != nil {
+			backfillKeys = append(backfillKeys, key)
+			backfillValues = append(backfillValues, b)
+		}
+		values[i] = b
+	}
+
+	if len(backfillKeys) > 0 {
+		cd.setLocalMany(backfillKeys, backfillValues)
+	}
+
+	return values, errs
+}
+
+// redisGetMany gets the keys from Redis without touching the local cache or
+// stats. The returned slices are aligned with keys and missing keys are
+// reported as redis.Nil. The keys are read with a pipeline of GET commands
+// per shard rather than MGET, so they don't have to live on the same Ring
+// shard or Cluster slot.
+func (cd *Cache) redisGetMany(ctx context.Context, keys []string) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	for shard, idxs := range cd.groupByShard(keys) {
+		if len(idxs) == 0 {
+			continue
+		}
+
+		cmds, err := cd.shards[shard].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range idxs {
+				pipe.Get(ctx, keys[i])
+			}
+			return nil
+		})
+		if len(cmds) != len(idxs) {
+			for _, i := range idxs {
+				errs[i] = err
+			}
+			continue
+		}
+
+		for j, cmd := range cmds {
+			values[idxs[j]], errs[idxs[j]] = cd.redisBytes(cmd.(*redis.StringCmd))
+		}
+	}
+
+	return values, errs
+}
+
+// setLocalFound stores the values read by redisGetMany without an error
+// in the local cache.
+func (cd *Cache) setLocalFound(keys []string, values [][]byte, errs []error) {
+	var foundKeys []string
+	var foundValues [][]byte
+	for i, err := range errs {
+		if err == nil {
+			foundKeys = append(foundKeys, keys[i])
+			foundValues = append(foundValues, values[i])
+		}
+	}
+	if len(foundKeys) > 0 {
+		cd.setLocalMany(foundKeys, foundValues)
+	}
+}
+
+// firstError returns the first error that is not a miss.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil && err != ErrCacheMiss && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrefetchLocal reads the keys that are not in the local cache from Redis
+// and stores them in the local cache, so that the following Gets are local
+// hits. Keys that Redis doesn't have are skipped. Prefetching does not count
+// towards the stats.
+func (cd *Cache) PrefetchLocal(ctx context.Context, keys []string) error {
+	if err := cd.checkKeys(keys); err != nil {
+		return err
+	}
+	if cd.opt.LocalCache == nil || len(cd.shards) == 0 {
+		return nil
+	}
+
+	var remaining []string
+	for _, key := range keys {
+		if _, ok := cd.opt.LocalCache.Get(key); !ok {
+			remaining = append(remaining, key)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	values, errs := cd.redisGetMany(ctx, remaining)
+	cd.setLocalFound(remaining, values, errs)
+	return firstError(errs)
+}
+
+// WarmLocalByPattern reads the keys matching the pattern from Redis into
+// the local cache, e.g. to load configuration keys on startup. It uses SCAN,
+// which walks the whole keyspace, so it is meant for small, bounded sets of
+// keys on a dedicated prefix and not for arbitrary patterns.
+func (cd *Cache) WarmLocalByPattern(ctx context.Context, pattern string) error {
+	if cd.opt.LocalCache == nil {
+		return nil
+	}
+
+	for _, shard := range cd.shards {
+		if err := forEachNode(ctx, shard, func(ctx context.Context, node scanner) error {
+			return cd.warmLocalNode(ctx, node, pattern)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cd *Cache) warmLocalNode(ctx context.Context, node scanner, pattern string) error {
+	const count = 100
+
+	var cursor uint64
+	for {
+		keys, next, err := node.Scan(ctx, cursor, pattern, count).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			values, errs := cd.redisGetMany(ctx, keys)
+			cd.setLocalFound(keys, values, errs)
+			if err := firstError(errs); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+type scanner interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+type shardIterator interface {
+	ForEachShard(context.Context, func(context.Context, *redis.Client) error) error
+}
+
+type masterIterator interface {
+	ForEachMaster(context.Context, func(context.Context, *redis.Client) error) error
+}
+
+// forEachNode calls fn for every Redis server behind the client, because
+// SCAN on a Ring or a Cluster only walks the keys of a single server.
+func forEachNode(
+	ctx context.Context, rdb Rediser, fn func(ctx context.Context, node scanner) error,
+) error {
+	clientFn := func(ctx context.Context, client *redis.Client) error {
+		return fn(ctx, client)
+	}
+
+	// An instrumented client has all the methods,
+	// so use the one that the wrapped client has.
+	client := rdb
+	if r, ok := rdb.(*instrumentedRediser); ok {
+		client = r.rdb
+	}
+
+	switch client.(type) {
+	case shardIterator:
+		return rdb.(shardIterator).ForEachShard(ctx, clientFn)
+	case masterIterator:
+		return rdb.(masterIterator).ForEachMaster(ctx, clientFn)
+	case scanner:
+		return fn(ctx, rdb.(scanner))
+	default:
+		return fmt.Errorf("cache: %T does not support SCAN", client)
+	}
+}
+
+// DecodeErrorPolicy is how GetBatch handles values that can't be decoded.
+type DecodeErrorPolicy uint8
+
+const (
+	// SkipOnDecodeError reports the error to Options.OnError and treats
+	// the key as a miss, so one corrupt value doesn't fail the batch.
+	SkipOnDecodeError DecodeErrorPolicy = iota
+	// FailOnDecodeError returns the decoding error for the key.
+	FailOnDecodeError
+	// DeleteOnDecodeError is like SkipOnDecodeError, but also deletes
+	// the key, so the corrupt value is not read again.
+	DeleteOnDecodeError
+)
+
+// GetBatch is a batch version of Get. It gets the keys into the values with
+// the same index and returns the errors aligned with the keys: nil on a hit,
+// ErrCacheMiss on a miss, the cached error for keys that hold one, the key
+// validation error, or the Redis error. Decoding errors are handled according to
+// Options.BatchDecodeErrorPolicy.
+func (cd *Cache) GetBatch(ctx context.Context, keys []string, values []interface{}) []error {
+	if len(values) != len(keys) {
+		panic("cache: GetBatch keys and values have different lengths")
+	}
+
+	b, errs := cd.getManyBytes(ctx, keys)
+	for i, err := range errs {
+		if err != nil {
+			continue
+		}
+
+		if err := cd.cachedError(b[i]); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		err = cd.unmarshal(b[i], values[i])
+		if err == nil || cd.opt.BatchDecodeErrorPolicy == FailOnDecodeError {
+			errs[i] = err
+			continue
+		}
+
+		cd.onError(fmt.Errorf("cache: skipping key=%q in batch: %w", keys[i], err))
+		if cd.opt.BatchDecodeErrorPolicy == DeleteOnDecodeError {
+			if err := cd.Delete(ctx, keys[i]); err != nil {
+				cd.onError(err)
+			}
+		}
+		errs[i] = ErrCacheMiss
+	}
+	return errs
+}
+
+// OnceBatch is a batch version of Once. It gets the keys from the cache and
+// calls load once with all the keys that are missing. The loaded values are
+// cached with the ttl and concurrent calls with the same missing keys share
+// a single load. Calls whose missing keys only overlap don't share it and
+// each load all of their missing keys.
+//
+// The values are decoded into dst, which maps keys to destination pointers.
+// Keys without a destination are still cached, and keys that load does not
+// return are left untouched. If a key with a destination holds a cached
+// error, the error is returned.
+func (cd *Cache) OnceBatch(
+	ctx context.Context,
+	keys []string,
+	load func(missing []string) (map[string]interface{}, error),
+	ttl time.Duration,
+	dst map[string]interface{},
+) error {
+	if len(keys) > 0 {
+		if err := cd.checkTTL(keys[0], ttl); err != nil {
+			return err
+		}
+	}
+
+	values, errs := cd.getManyBytes(ctx, keys)
+	if err := firstError(errs); err != nil {
+		return err
+	}
+
+	var missing []string
+	for i, err := range errs {
+		if err == ErrCacheMiss {
+			missing = append(missing, keys[i])
+		}
+	}
+
+	var loaded map[string][]byte
+	if len(missing) > 0 {
+		v, err, _ := cd.group.Do(batchGroupKey(missing), func() (interface{}, error) {
+			m, err := cd.loadBatch(ctx, missing, load)
+			if err != nil {
+				return nil, err
+			}
+
+			loaded := make(map[string][]byte, len(m))
+			for key, value := range m {
+				if err := cd.checkKey(key); err != nil {
+					return nil, err
+				}
+				b, _, err := cd.set(&Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: value,
+					TTL:   ttl,
+				})
+				if err != nil {
+					return nil, err
+				}
+				loaded[key] = b
+			}
+			return loaded, nil
+		})
+		if err != nil {
+			return err
+		}
+		loaded = v.(map[string][]byte)
+	}
+
+	for i, key := range keys {
+		value, ok := dst[key]
+		if !ok || value == nil {
+			continue
+		}
+
+		b := values[i]
+		if errs[i] == ErrCacheMiss {
+			b, ok = loaded[key]
+			if !ok {
+				continue
+			}
+		}
+
+		if err := cd.cachedError(b); err != nil {
+			return err
+		}
+		if err := cd.unmarshal(b, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadBatch calls load with the missing keys in chunks of
+// Options.BatchLoadSize and merges the results.
+func (cd *Cache) loadBatch(
+	ctx context.Context,
+	missing []string,
+	load func(missing []string) (map[string]interface{}, error),
+) (map[string]interface{}, error) {
+	// A call made by Do already holds a slot and loads in that slot.
+	sem := cd.funcSem
+	if cd.holdsFuncSem(ctx) {
+		sem = nil
+	}
+
+	size := cd.opt.BatchLoadSize
+	if size <= 0 || len(missing) <= size {
+		if sem == nil {
+			return load(missing)
+		}
+
+		select {
+		case cd.funcSem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-cd.funcSem }()
+
+		return load(missing)
+	}
+
+	var chunks [][]string
+	for len(missing) > size {
+		chunks = append(chunks, missing[:size:size])
+		missing = missing[size:]
+	}
+	chunks = append(chunks, missing)
+
+	results := make([]map[string]interface{}, len(chunks))
+	if sem == nil {
+		for i, chunk := range chunks {
+			m, err := load(chunk)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = m
+		}
+	} else {
+		g, gctx := errgroup.WithContext(ctx)
+	loop:
+		for i, chunk := range chunks {
+			i, chunk := i, chunk
+
+			select {
+			case cd.funcSem <- struct{}{}:
+			case <-gctx.Done():
+				break loop
+			}
+
+			g.Go(func() error {
+				defer func() { <-cd.funcSem }()
+
+				m, err := load(chunk)
+				results[i] = m
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	loaded := make(map[string]interface{})
+	for _, m := range results {
+		for key, value := range m {
+			loaded[key] = value
+		}
+	}
+	return loaded, nil
+}
+
+func batchGroupKey(keys []string) string {
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	return "\x00batch\x00" + strings.Join(sorted, "\x00")
+}
+
+// setBytesWithSide is like setBytes, but also caches the side items returned
+// by Do and writes all of them with a pipeline per shard. SkipUnchangedWrites
+// does not apply to the pipelined writes.
+func (cd *Cache) setBytesWithSide(item *Item, b []byte, side []*Item) error {
+	if len(side) == 0 {
+		return cd.setBytes(item, b)
+	}
+
+	items, values, err := cd.appendSide([]*Item{item}, [][]byte{b}, side)
+	if err != nil {
+		return err
+	}
+	return cd.setPipelined(item.Context(), items, values)
+}
+
+// setSide caches the side items returned by Do with a pipeline per shard.
+func (cd *Cache) setSide(ctx context.Context, side []*Item) error {
+	if len(side) == 0 {
+		return nil
+	}
+
+	items, values, err := cd.appendSide(nil, nil, side)
+	if err != nil {
+		return err
+	}
+	return cd.setPipelined(ctx, items, values)
+}
+
+// appendSide encodes the side items and appends them to items and values.
+// Side items larger than their MaxSize are skipped.
+func (cd *Cache) appendSide(
+	items []*Item, values [][]byte, side []*Item,
+) ([]*Item, [][]byte, error) {
+	for _, sideItem := range side {
+		b, err := cd.marshalKey(sideItem.Key, sideItem.Value, sideItem.Compress)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sideItem.MaxSize > 0 && len(b) > sideItem.MaxSize {
+			continue
+		}
+		if sideItem.Version != 0 {
+			b = setVersion(b, sideItem.Version)
+		}
+		items = append(items, sideItem)
+		values = append(values, b)
+	}
+	return items, values, nil
+}
+
+// setPipelined caches the encoded values of the items, writing them with
+// a pipeline per shard.
+func (cd *Cache) setPipelined(ctx context.Context, items []*Item, values [][]byte) error {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		if !item.SkipLocalCache {
+			cd.setLocalOnWrite(item.Key, values[i])
+		}
+		keys[i] = item.Key
+	}
+
+	if cd.opt.ReadOnly || len(cd.shards) == 0 {
+		return nil
+	}
+
+	for shard, idxs := range cd.groupByShard(keys) {
+		if len(idxs) == 0 {
+			continue
+		}
+
+		_, err := cd.shards[shard].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range idxs {
+				item := items[i]
+
+				ttl := cd.redisTTL(item)
+				if ttl == 0 {
+					continue
+				}
+				if item.KeepTTL {
+					ttl = redis.KeepTTL
+				}
+
+				switch {
+				case item.SetXX:
+					pipe.SetXX(ctx, item.Key, values[i], ttl)
+				case item.SetNX:
+					pipe.SetNX(ctx, item.Key, values[i], ttl)
+				default:
+					pipe.Set(ctx, item.Key, values[i], ttl)
+				}
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
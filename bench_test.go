@@ -1,8 +1,13 @@
 package cache_test
 
 import (
+	"context"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/go-redis/cache/v8"
 )
@@ -36,6 +41,36 @@ func BenchmarkOnce(b *testing.B) {
 	})
 }
 
+func BenchmarkOnceHotKeys(b *testing.B) {
+	mycache := cache.New(&cache.Options{
+		LocalCache: cache.NewTinyLFU(10000, time.Minute),
+		HotKeys:    1000,
+	})
+
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "bench-hot-" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			err := mycache.Once(&cache.Item{
+				Key: keys[i%len(keys)],
+				Do: func(*cache.Item) (interface{}, error) {
+					return "value", nil
+				},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
 func BenchmarkSet(b *testing.B) {
 	mycache := newCacheWithLocal(newRing())
 	obj := &Object{
@@ -56,3 +91,98 @@ func BenchmarkSet(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkGet(b *testing.B) {
+	mycache := newCacheWithLocal(newRing())
+	obj := &Object{
+		Str: strings.Repeat("my very large string", 10),
+		Num: 42,
+	}
+	if err := mycache.Set(&cache.Item{
+		Key:   "bench-get",
+		Value: obj,
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.TODO()
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var dst Object
+			if err := mycache.Get(ctx, "bench-get", &dst); err != nil {
+				b.Fatal(err)
+			}
+			if dst.Num != 42 {
+				b.Fatalf("%d != 42", dst.Num)
+			}
+		}
+	})
+}
+
+// BenchmarkLocalBackfill compares storing a batch of values read from Redis
+// in the local cache one by one and with SetMany, which locks the cache once
+// per batch instead of once per value.
+func BenchmarkLocalBackfill(b *testing.B) {
+	const batchSize = 100
+
+	keys := make([]string, batchSize)
+	values := make([][]byte, batchSize)
+	for i := range keys {
+		keys[i] = "bench-backfill-" + strconv.Itoa(i)
+		values[i] = []byte(strings.Repeat("x", 100))
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		local := cache.NewTinyLFU(1000, time.Minute)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for i, key := range keys {
+					local.Set(key, values[i])
+				}
+			}
+		})
+	})
+
+	b.Run("SetMany", func(b *testing.B) {
+		local := cache.NewTinyLFU(1000, time.Minute)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				local.SetMany(keys, values)
+			}
+		})
+	})
+}
+
+func BenchmarkMarshalTime(b *testing.B) {
+	mycache := cache.New(&cache.Options{})
+	tm := time.Now()
+
+	b.Run("cache", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			data, err := mycache.Marshal(tm)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n = len(data)
+		}
+		b.ReportMetric(float64(n), "bytes/value")
+	})
+
+	b.Run("msgpack", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			data, err := msgpack.Marshal(tm)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n = len(data)
+		}
+		b.ReportMetric(float64(n), "bytes/value")
+	})
+}
@@ -1,42 +1,194 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 	"github.com/vmihailenco/bufpool"
 	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/exp/rand"
 	"golang.org/x/sync/singleflight"
 )
 
 const (
 	compressionThreshold = 64
-	timeLen              = 4
+
+	onceMaxRetries   = 2
+	onceRetryBackoff = 10 * time.Millisecond
 )
 
 const (
-	noCompression = 0x0
-	s2Compression = 0x1
+	noCompression       = 0x0
+	s2Compression       = 0x1
+	zstdCompression     = 0x2
+	zstdDictCompression = 0x3
 )
 
 var (
 	ErrCacheMiss          = errors.New("cache: key is missing")
-	errRedisLocalCacheNil = errors.New("cache: both Redis and LocalCache are nil")
+	ErrLocalCacheMismatch = errors.New("cache: local cache value differs from Redis")
+
+	// ErrSkipCache can be returned by Item.Do along with a value to return
+	// the value to the caller without caching it.
+	ErrSkipCache = errors.New("cache: skip caching the value")
+
+	// ErrNilValue is returned when an item without a value is cached
+	// and Options.RejectNilValue is set.
+	ErrNilValue = errors.New("cache: item value is nil")
+
+	// ErrReadOnly is returned by the methods that write to Redis
+	// when Options.ReadOnly is set.
+	ErrReadOnly = errors.New("cache: cache is read-only")
+
+	// ErrMissingTTL is returned for items without a TTL
+	// when Options.RequireExplicitTTL is set.
+	ErrMissingTTL = errors.New("cache: item has no TTL")
+
+	// ErrKeyTooLong is returned for keys longer than
+	// Options.MaxKeyLength.
+	ErrKeyTooLong = errors.New("cache: key is too long")
+
+	// ErrNoBackend is returned when the cache is configured with neither
+	// Redis nor LocalCache, which is a configuration mistake rather than
+	// a runtime error.
+	ErrNoBackend = errors.New("cache: both Redis and LocalCache are nil")
+
+	// ErrNoRedis is returned by the methods that only work with Redis, like
+	// GetSet, Take, DecrementFloor, GetWithTTL and RedisBytes, when the cache
+	// is created without it.
+	ErrNoRedis = errors.New("cache: Redis is nil")
+
+	// ErrAgeUnknown is returned by Age for keys that are in Redis,
+	// but not in the local cache.
+	ErrAgeUnknown = errors.New("cache: key is only in Redis and its age is unknown")
 )
 
-type rediser interface {
+// Rediser is the part of the go-redis API the cache uses. It is implemented
+// by *redis.Client, *redis.Ring and *redis.ClusterClient.
+type Rediser interface {
 	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd
 	SetXX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd
 	SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd
 
 	Get(ctx context.Context, key string) *redis.StringCmd
+	GetSet(ctx context.Context, key string, value interface{}) *redis.StringCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	PExpire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd
+	Exists(ctx context.Context, keys ...string) *redis.IntCmd
+	StrLen(ctx context.Context, key string) *redis.IntCmd
+
+	Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+}
+
+// BufferPool is a pool of encoding and decompression buffers. It is
+// implemented by bufpool.Pool. A buffer returned by Get is passed to Put
+// once the value is copied out of it.
+type BufferPool interface {
+	Get() *bufpool.Buffer
+	Put(buf *bufpool.Buffer)
+}
+
+// NoBufferPool is a BufferPool that allocates a new buffer for every value,
+// which can be cheaper than pooling when values are always small.
+var NoBufferPool BufferPool = noBufferPool{}
+
+type noBufferPool struct{}
+
+func (noBufferPool) Get() *bufpool.Buffer {
+	return bufpool.NewBuffer(nil)
+}
+
+func (noBufferPool) Put(*bufpool.Buffer) {}
+
+// SideValues can be returned by Item.Do to cache additional items that are
+// computed along with the value, e.g. for a denormalized cache fill. The
+// items are written in the same pipeline as the value, and consist of the
+// Key, Value, TTL and the other options that don't involve Do. They are
+// checked like the value: Options.RequireExplicitTTL and
+// Options.RejectNilValue fail the call, and items larger than their MaxSize
+// are not cached.
+type SideValues struct {
+	Value interface{}
+	Items []*Item
+}
+
+// ttler is implemented by local caches with a fixed TTL.
+type ttler interface {
+	TTL() time.Duration
+}
+
+// clockSetter is implemented by local caches that use a Clock.
+type clockSetter interface {
+	SetClock(clock Clock)
+}
+
+// maxAgeSetter is implemented by local caches that can limit the age
+// of entries.
+type maxAgeSetter interface {
+	SetMaxAge(age time.Duration)
+}
+
+// idleTTLSetter is implemented by local caches that support idle expiration.
+type idleTTLSetter interface {
+	SetIdleTTL(ttl time.Duration)
+}
+
+// ager is implemented by local caches that know when entries were set.
+type ager interface {
+	Age(key string) (time.Duration, bool)
+}
+
+// prefixDeleter is implemented by local caches that can delete entries
+// by key prefix.
+type prefixDeleter interface {
+	DelPrefix(prefix string)
+}
+
+// toucher is implemented by local caches that can restart the TTL of an
+// entry without setting it again.
+type toucher interface {
+	Touch(key string) bool
+}
+
+// keyIndexSetter is implemented by local caches that index their keys
+// for DelPrefix on demand.
+type keyIndexSetter interface {
+	SetKeyIndex(enabled bool)
+}
+
+// manySetter is implemented by local caches that can set many entries
+// at once cheaper than one by one.
+type manySetter interface {
+	SetMany(keys []string, values [][]byte)
+}
+
+// staleGetter is implemented by local caches that keep expired entries.
+type staleGetter interface {
+	GetStale(key string) ([]byte, bool)
+}
+
+// evictNotifier is implemented by local caches that report evictions.
+type evictNotifier interface {
+	SetOnEvict(fn func(key string))
 }
 
 type Item struct {
@@ -45,21 +197,88 @@ type Item struct {
 	Key   string
 	Value interface{}
 
-	// TTL is the cache expiration time.
+	// TTL is the cache expiration time. TTLs shorter than 1 second are
+	// replaced with the default unless Options.AllowSubSecondTTL is set.
 	// Default TTL is 1 hour.
 	TTL time.Duration
 
-	// Do returns value to be cached.
+	// Do returns value to be cached. Returning ErrSkipCache with the value
+	// hands the value to the caller without caching it. An error of a type
+	// registered with RegisterType, e.g. a not found error, is cached in
+	// place of the value, and Once and Get return it on a hit. Only the
+	// exact type is matched, so wrapped errors, e.g. created by fmt.Errorf
+	// with %w, are not cached.
 	Do func(*Item) (interface{}, error)
 
+	// DoTTL is used instead of Do when Do is nil. It also returns the TTL
+	// to cache the value with, e.g. the expiry of a token returned by an
+	// upstream service. A zero TTL uses TTL. With
+	// Options.RequireExplicitTTL the TTL is checked after DoTTL returns.
+	DoTTL func(*Item) (interface{}, time.Duration, error)
+
+	// PostCompute is called with the value returned by Do before it is
+	// encoded, e.g. to normalize it into a canonical form. For SideValues
+	// it is only called with the main value.
+	PostCompute func(interface{}) (interface{}, error)
+
+	// Fallback, if not nil, is returned by Once instead of the error when
+	// Do fails. The error is reported to Options.OnError.
+	Fallback interface{}
+
+	// FallbackTTL, if positive, caches the Fallback for the given TTL,
+	// so Do is not called for every request while it keeps failing.
+	// The local cache keeps it for the local cache TTL.
+	FallbackTTL time.Duration
+
+	// GroupKey, if set, is used instead of Key to deduplicate concurrent
+	// Once calls, so items with different keys can share a single Do call.
+	// The value is still cached under the Key of every item.
+	GroupKey string
+
+	// BoundDoByTTL runs Do with a context that is canceled after TTL
+	// and fails if Do does not finish in time, because such a value
+	// would expire before it is cached.
+	BoundDoByTTL bool
+
 	// SetXX only sets the key if it already exists.
 	SetXX bool
 
 	// SetNX only sets the key if it does not already exist.
 	SetNX bool
 
+	// KeepTTL keeps the TTL of an existing Redis key using SET KEEPTTL
+	// instead of setting TTL. A new key is created without expiration.
+	// It requires Redis 6.0.
+	KeepTTL bool
+
 	// SkipLocalCache skips local cache as if it is not set.
 	SkipLocalCache bool
+
+	// CapTTLToDeadline caps the Redis TTL at the time left until the
+	// deadline of Ctx, so request-scoped values don't outlive the request.
+	// The value is not written to Redis when the deadline has passed.
+	// The local cache TTL is not affected.
+	CapTTLToDeadline bool
+
+	// SkipStats excludes the Once lookup of the item from the stats.
+	// Use WithoutStats for other operations.
+	SkipStats bool
+
+	// Version is stored with the encoded value. Once treats a value stored
+	// with a different version as a miss, so bumping the version after
+	// changing the shape of the value invalidates the old entries. Get
+	// decodes values of any version. Strings, byte slices and values
+	// encoded with Options.Marshal don't carry a version.
+	Version uint16
+
+	// MaxSize, if positive, is the maximum size of the encoded value.
+	// Larger values are returned by Once, but are not cached.
+	MaxSize int
+
+	// Compress, if not nil, overrides whether the value is compressed,
+	// regardless of its size. Strings, byte slices and values encoded with
+	// Options.Marshal are never compressed.
+	Compress *bool
 }
 
 func (item *Item) Context() context.Context {
@@ -69,29 +288,108 @@ func (item *Item) Context() context.Context {
 	return item.Ctx
 }
 
-func (item *Item) value() (interface{}, error) {
-	if item.Do != nil {
-		return item.Do(item)
+// value returns the item value and the TTL returned by DoTTL.
+func (item *Item) value(minTTL time.Duration) (interface{}, time.Duration, error) {
+	if item.hasDo() {
+		v, ttl, err := item.do(minTTL)
+		if item.PostCompute == nil || (err != nil && err != ErrSkipCache) {
+			return v, ttl, err
+		}
+
+		if sv, ok := v.(*SideValues); ok {
+			value, postErr := item.PostCompute(sv.Value)
+			if postErr != nil {
+				return nil, 0, postErr
+			}
+			return &SideValues{Value: value, Items: sv.Items}, ttl, err
+		}
+
+		v, postErr := item.PostCompute(v)
+		if postErr != nil {
+			return nil, 0, postErr
+		}
+		return v, ttl, err
 	}
 	if item.Value != nil {
-		return item.Value, nil
+		return item.Value, 0, nil
+	}
+	return nil, 0, nil
+}
+
+func (item *Item) hasDo() bool {
+	return item.Do != nil || item.DoTTL != nil
+}
+
+func (item *Item) do(minTTL time.Duration) (interface{}, time.Duration, error) {
+	if item.BoundDoByTTL {
+		return item.boundDo(minTTL)
+	}
+	return item.call()
+}
+
+// call calls Do or DoTTL and returns the TTL returned by DoTTL.
+func (item *Item) call() (interface{}, time.Duration, error) {
+	if item.Do != nil {
+		v, err := item.Do(item)
+		return v, 0, err
+	}
+	return item.DoTTL(item)
+}
+
+// usesDoTTL reports whether the TTL is returned by DoTTL.
+func (item *Item) usesDoTTL() bool {
+	return item.Do == nil && item.DoTTL != nil
+}
+
+// withTTL returns a copy of the item with the TTL returned by DoTTL.
+func (item *Item) withTTL(ttl time.Duration) *Item {
+	if ttl == 0 {
+		return item
+	}
+	cp := *item
+	cp.TTL = ttl
+	return &cp
+}
+
+func (item *Item) boundDo(minTTL time.Duration) (interface{}, time.Duration, error) {
+	ttl := item.ttl(minTTL)
+	if ttl == 0 {
+		return item.call()
+	}
+
+	parent := item.Ctx
+	ctx, cancel := context.WithTimeout(item.Context(), ttl)
+	defer cancel()
+
+	item.Ctx = ctx
+	v, doTTL, err := item.call()
+	item.Ctx = parent
+
+	if err != nil {
+		return v, doTTL, err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, 0, fmt.Errorf("cache: Do for key=%q took longer than TTL=%s", item.Key, ttl)
 	}
-	return nil, nil
+	return v, doTTL, nil
 }
 
-func (item *Item) ttl() time.Duration {
+// ttl returns the TTL of the item. TTLs shorter than minTTL are replaced
+// with the default.
+func (item *Item) ttl(minTTL time.Duration) time.Duration {
 	const defaultTTL = time.Hour
 
-	if item.TTL < 0 {
+	ttl := item.TTL
+	if ttl < 0 {
 		return 0
 	}
 
-	if item.TTL != 0 {
-		if item.TTL < time.Second {
-			log.Printf("too short TTL for key=%q: %s", item.Key, item.TTL)
+	if ttl != 0 {
+		if ttl < minTTL {
+			log.Printf("too short TTL for key=%q: %s", item.Key, ttl)
 			return defaultTTL
 		}
-		return item.TTL
+		return ttl
 	}
 
 	return defaultTTL
@@ -102,29 +400,353 @@ type MarshalFunc func(interface{}) ([]byte, error)
 type UnmarshalFunc func([]byte, interface{}) error
 
 type Options struct {
-	Redis        rediser
+	Redis Rediser
+
+	// RedisShards spreads keys across several Redis instances without
+	// Redis Cluster. It is used instead of Redis when set.
+	RedisShards []redis.Cmdable
+	// ShardFunc selects the shard for a key. Default is JumpHash.
+	ShardFunc ShardFunc
+
 	LocalCache   LocalCache
 	StatsEnabled bool
 	Marshal      MarshalFunc
-	Unmarshal    UnmarshalFunc
+	// Unmarshal may be passed bytes owned by the local cache,
+	// so it must not modify or retain them.
+	Unmarshal UnmarshalFunc
+
+	// SortMapKeys sorts map keys when values are encoded with msgpack,
+	// so equal maps are encoded into identical bytes. msgpack only sorts
+	// map[string]string and map[string]interface{}, including the ones
+	// nested in other values; keys of other map types keep Go's random
+	// order.
+	SortMapKeys bool
+
+	// BufferPool provides the buffers values are encoded into with msgpack.
+	// Default is a bufpool.Pool. Use NoBufferPool to disable pooling.
+	BufferPool BufferPool
+
+	// Compression is used for encoded values of at least 64 bytes.
+	// Default is CompressionS2.
+	Compression Compression
+	// CompressionDict is a zstd dictionary, e.g. created with
+	// `zstd --train`. When set, all encoded values are compressed
+	// with zstd using the dictionary.
+	CompressionDict []byte
+
+	// ReadOrder is the order in which Get, Once, GetBatch and OnceBatch
+	// look up values.
+	// Default is LocalFirst.
+	ReadOrder ReadOrder
+
+	// ReadRepairRate is the probability, from 0 to 1, that a local cache
+	// hit is verified against Redis. On mismatch the local entry is
+	// replaced with the Redis value and ErrLocalCacheMismatch is reported
+	// to OnError.
+	ReadRepairRate float64
+
+	// SkipUnchangedWrites skips writing a value to Redis when the local
+	// cache already holds the same encoded value, and only refreshes the
+	// key TTL. It is only safe when this process is the only writer of the
+	// keys, because a value changed by another writer is not overwritten.
+	SkipUnchangedWrites bool
+
+	// MaxConcurrentFuncs, if positive, limits the number of Item.Do and
+	// OnceBatch load calls that run at the same time across all keys.
+	// Calls over the limit wait until the context is done. Once and
+	// OnceBatch calls made by Do with the item context don't take another
+	// slot. load isn't given a context, so calls made by load do and may
+	// wait forever if all slots are held.
+	MaxConcurrentFuncs int
+
+	// BatchLoadSize, if positive, makes OnceBatch call load with at most
+	// the given number of missing keys at a time. The chunks are loaded
+	// one after another or, when MaxConcurrentFuncs is set, concurrently
+	// within that limit.
+	BatchLoadSize int
+
+	// BatchDecodeErrorPolicy is how GetBatch handles values that can't be
+	// decoded. Default is SkipOnDecodeError.
+	BatchDecodeErrorPolicy DecodeErrorPolicy
+
+	// RejectNilValue makes Set and Once fail with ErrNilValue instead of
+	// caching nil when the item has no Value or Do returns nil, which is
+	// usually a forgotten Value. By default nil is cached as a marker that
+	// Get reports as a hit without changing the destination.
+	RejectNilValue bool
+
+	// EmptyAsMiss treats empty values in Redis as missing keys, so Once
+	// recomputes values that were overwritten with an empty string.
+	EmptyAsMiss bool
+
+	// DecodeJSON decodes values stored as JSON objects, arrays or strings
+	// without the header of this package with encoding/json, e.g. while
+	// migrating from JSON to msgpack. It does not apply to Options.Unmarshal.
+	DecodeJSON bool
+
+	// ReadOnly makes methods that write to Redis, like Set and Delete,
+	// return ErrReadOnly. Once still calls Do on a miss and returns the
+	// value, but only stores it in the local cache.
+	ReadOnly bool
+
+	// MaxLocalSize, if positive, is the maximum size of encoded values
+	// stored in the local cache. Larger values, e.g. blobs cached with
+	// SetReader, are only stored in Redis.
+	MaxLocalSize int
+
+	// SkipLocalCacheOnSet does not store written values in the local cache,
+	// e.g. in a writer process that never reads them. Values read from Redis
+	// are still stored locally. It requires Redis.
+	SkipLocalCacheOnSet bool
+
+	// RedisTTLFunc derives the Redis TTL of items without a TTL from the
+	// local cache TTL, e.g. to keep values in Redis 10 times longer.
+	// It requires a LocalCache with a TTL() method, like TinyLFU, and
+	// the returned TTL is used as is.
+	RedisTTLFunc func(localTTL time.Duration) time.Duration
+
+	// AllowSubSecondTTL keeps item TTLs down to 1 millisecond, which Redis
+	// stores with PX precision. By default TTLs shorter than 1 second are
+	// logged and replaced with the default of 1 hour.
+	AllowSubSecondTTL bool
+
+	// VerifyLocalKey stores the key along with every local cache entry and
+	// treats an entry that was stored for a different key as a miss. TinyLFU
+	// never mixes up keys, so this is only useful with LocalCache
+	// implementations that index entries by a hash of the key.
+	VerifyLocalKey bool
+
+	// LocalCacheIdleTTL, if positive, makes local entries expire when they
+	// are not read for the duration instead of the local cache TTL. It
+	// requires a LocalCache with a SetIdleTTL(time.Duration) method, like
+	// TinyLFU, and is ignored otherwise.
+	LocalCacheIdleTTL time.Duration
+
+	// LocalMaxAge, if positive, is the maximum time since a local entry was
+	// set that it is served for, even when LocalCacheIdleTTL keeps it from
+	// expiring or ServeStaleOnRedisError serves it stale. It requires
+	// a LocalCache with a SetMaxAge(time.Duration) method, like TinyLFU,
+	// and is ignored otherwise.
+	LocalMaxAge time.Duration
+
+	// ReadTimeout, if positive, bounds the Redis reads of Get, Once,
+	// GetBatch and OnceBatch.
+	// Combined with ServeStaleOnRedisError, a read that takes longer
+	// serves the stale local value, which keeps latency bounded while
+	// Redis is slow.
+	ReadTimeout time.Duration
+
+	// ServeStaleOnRedisError serves an expired local value when Redis
+	// returns an error, and reports the error to OnError. It requires
+	// a LocalCache with a GetStale(key string) ([]byte, bool) method,
+	// like TinyLFU, and is ignored otherwise.
+	ServeStaleOnRedisError bool
+
+	// Clock is used for local cache expiration. Default is the system
+	// clock. It requires a LocalCache with a SetClock(Clock) method, like
+	// TinyLFU, and is ignored otherwise.
+	Clock Clock
+
+	// LocalKeyIndex makes the local cache index its keys, which
+	// DeleteFromLocalCacheByPrefix requires with TinyLFU. It requires
+	// a LocalCache with a SetKeyIndex(bool) method, like TinyLFU, and
+	// is ignored otherwise.
+	LocalKeyIndex bool
+
+	// OnLocalEvict is called with the key of an entry that leaves the
+	// local cache. It requires a LocalCache that reports evictions with a
+	// SetOnEvict(func(key string)) method, like TinyLFU, and is ignored
+	// otherwise. The reports are best effort, see TinyLFU.SetOnEvict.
+	OnLocalEvict func(key string)
+
+	// OnMiss is called when the key is missing in both the local cache
+	// and Redis, including the lookup Once does before calling Do.
+	OnMiss func(key string)
+
+	// OnMarshalError is called when a value can't be marshaled,
+	// before the error is returned to the caller.
+	OnMarshalError func(key string, value interface{}, err error)
+
+	// RequireExplicitTTL makes the methods that write values return
+	// ErrMissingTTL for items without a TTL instead of using the default
+	// of 1 hour. A negative TTL, which caches the item only locally and
+	// does not write it to Redis, is explicit too.
+	// Items without a TTL are allowed when RedisTTLFunc is set.
+	RequireExplicitTTL bool
+
+	// MaxKeyLength, if positive, makes the methods that take keys, e.g. Set,
+	// Get, Once and Delete, return ErrKeyTooLong for keys longer than the
+	// given number of bytes. The keys of side items are checked too.
+	MaxKeyLength int
+
+	// ValidateKey, if not nil, is called with the key by the methods that
+	// take keys, e.g. Set, Get, Once and Delete, which return its error
+	// without accessing the cache, e.g. to reject keys without a tenant
+	// prefix. Methods that report a bool treat an invalid key as missing.
+	ValidateKey func(key string) error
+
+	// RecoverFunc makes Once recover panics in Item.Do and return them
+	// as errors that include the stack trace.
+	RecoverFunc bool
+
+	// NegativeTTL, if not zero, is the TTL of the errors cached for
+	// Item.Do instead of the item TTL, so that e.g. a not found error
+	// does not outlive the creation of the record by long. The local
+	// cache keeps them for the local cache TTL.
+	NegativeTTL time.Duration
+
+	// UnifiedSingleFlight makes Get and GetSkippingLocalCache wait for
+	// a concurrent Once call that computes the value of a missing key
+	// and return the value it cached instead of ErrCacheMiss. Otherwise
+	// Get never waits for Item.Do.
+	UnifiedSingleFlight bool
+
+	// HotKeys, if positive, counts the Once calls per key in a fixed
+	// amount of memory and keeps the given number of the most requested
+	// keys for TopKeys.
+	HotKeys int
+
+	// ReadTransform, if not nil, is called with the values read by Get,
+	// GetWithTTL, Once and the batch methods before they are decoded, e.g.
+	// to migrate values stored in an old format, which can be told apart
+	// with Item.Version. A non-nil result replaces the value and is written
+	// back keeping the TTL of the key, which requires Redis 6.0, so later
+	// reads get the new value. Keys that are no longer in Redis are only
+	// updated in the local cache. It returns nil to keep the value as is.
+	ReadTransform func(key string, b []byte) ([]byte, error)
+
+	// SlowThreshold, if positive, reports Get, Set, Once and Delete calls
+	// that take longer to OnSlow and counts them in Stats.SlowOps.
+	SlowThreshold time.Duration
+
+	// OnSlow is called with the operation name, e.g. "get", the key and
+	// the duration of operations slower than SlowThreshold.
+	OnSlow func(op, key string, dur time.Duration)
+
+	// ObserveLatency, if not nil, is called with the duration of the reads
+	// of Get and Once, op "get", the writes of Set and Once, op "set", and
+	// the Item.Do calls of Once, op "once". The source is "local" or
+	// "redis" for reads and writes and "do" for Item.Do, e.g. to feed
+	// a histogram per layer.
+	ObserveLatency func(op, source string, dur time.Duration)
+
+	// OnError is called with errors that are handled by the cache
+	// and not returned to the caller.
+	OnError func(err error)
 }
 
 type Cache struct {
 	opt *Options
 
+	shards    []Rediser
+	shardFunc ShardFunc
+
+	localTTL time.Duration
+
 	group   singleflight.Group
-	bufpool bufpool.Pool
+	funcSem chan struct{}
+
+	flightsMu sync.Mutex
+	flights   map[string]chan struct{}
+
+	hotKeys *hotKeys
+	bufpool BufferPool
 
 	marshal   MarshalFunc
 	unmarshal UnmarshalFunc
 
-	hits   uint64
-	misses uint64
+	zstdEnc     *zstd.Encoder
+	zstdDict    bool
+	zstdDec     *zstd.Decoder
+	zstdDecErr  error
+	zstdDecOnce sync.Once
+
+	hits     uint64
+	misses   uint64
+	slowOps  uint64
+	computed uint64
+	shared   uint64
+	errors   uint64
 }
 
 func New(opt *Options) *Cache {
 	cacher := &Cache{
-		opt: opt,
+		opt:     opt,
+		bufpool: opt.BufferPool,
+	}
+	if cacher.bufpool == nil {
+		cacher.bufpool = new(bufpool.Pool)
+	}
+
+	if local, ok := opt.LocalCache.(ttler); ok {
+		cacher.localTTL = local.TTL()
+	}
+
+	if opt.Clock != nil {
+		if local, ok := opt.LocalCache.(clockSetter); ok {
+			local.SetClock(opt.Clock)
+		}
+	}
+
+	if opt.LocalCacheIdleTTL > 0 {
+		if local, ok := opt.LocalCache.(idleTTLSetter); ok {
+			local.SetIdleTTL(opt.LocalCacheIdleTTL)
+		}
+	}
+
+	if opt.LocalMaxAge > 0 {
+		if local, ok := opt.LocalCache.(maxAgeSetter); ok {
+			local.SetMaxAge(opt.LocalMaxAge)
+		}
+	}
+
+	if opt.LocalKeyIndex {
+		if local, ok := opt.LocalCache.(keyIndexSetter); ok {
+			local.SetKeyIndex(true)
+		}
+	}
+
+	if opt.OnLocalEvict != nil {
+		if local, ok := opt.LocalCache.(evictNotifier); ok {
+			local.SetOnEvict(opt.OnLocalEvict)
+		}
+	}
+
+	if opt.VerifyLocalKey && opt.LocalCache != nil {
+		cp := *opt
+		cp.LocalCache = &keyedLocalCache{LocalCache: opt.LocalCache}
+		cacher.opt = &cp
+	}
+
+	if len(opt.RedisShards) > 0 {
+		cacher.shards = make([]Rediser, len(opt.RedisShards))
+		for i, shard := range opt.RedisShards {
+			cacher.shards[i] = shard
+		}
+	} else if opt.Redis != nil {
+		cacher.shards = []Rediser{opt.Redis}
+	}
+
+	if opt.MaxConcurrentFuncs > 0 {
+		cacher.funcSem = make(chan struct{}, opt.MaxConcurrentFuncs)
+	}
+	if opt.HotKeys > 0 {
+		cacher.hotKeys = newHotKeys(opt.HotKeys)
+	}
+
+	if opt.ShardFunc == nil {
+		cacher.shardFunc = JumpHash
+	} else {
+		cacher.shardFunc = opt.ShardFunc
+	}
+
+	if opt.Compression == CompressionZstd || opt.CompressionDict != nil {
+		cacher.zstdDict = opt.CompressionDict != nil
+		enc, err := zstdEncoder(opt.CompressionDict)
+		if err != nil {
+			panic(fmt.Errorf("cache: invalid zstd options: %w", err))
+		}
+		cacher.zstdEnc = enc
 	}
 
 	if opt.Marshal == nil {
@@ -141,182 +763,1309 @@ func New(opt *Options) *Cache {
 	return cacher
 }
 
+// NewLocalOnly returns a cache without Redis that keeps up to size entries
+// in a TinyLFU local cache for the exact ttl, without the randomized offset,
+// e.g. for tests of code that uses the cache.
+func NewLocalOnly(size int, ttl time.Duration) *Cache {
+	local := NewTinyLFU(size, ttl)
+	local.UseRandomizedTTL(0)
+	return New(&Options{
+		LocalCache: local,
+	})
+}
+
 // Set caches the item.
 func (cd *Cache) Set(item *Item) error {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("set", item.Key, time.Now())
+	}
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := cd.checkKey(item.Key); err != nil {
+		return err
+	}
+	if err := cd.checkItemTTL(item); err != nil {
+		return err
+	}
 	_, _, err := cd.set(item)
 	return err
 }
 
-func (cd *Cache) set(item *Item) ([]byte, bool, error) {
-	value, err := item.value()
-	if err != nil {
-		return nil, false, err
+// Refresh calls Item.Do and caches the value in place of the current one,
+// e.g. when the underlying data is known to have changed, so that readers
+// don't wait for the value to be recomputed as they would after Delete.
+// Like Once, it decodes the value into Item.Value. Concurrent refreshes of
+// the same key share a single Do call. Items without Do are cached like
+// with Set.
+func (cd *Cache) Refresh(item *Item) error {
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
 	}
-
-	b, err := cd.Marshal(value)
-	if err != nil {
-		return nil, false, err
+	if err := cd.checkKey(item.Key); err != nil {
+		return err
+	}
+	if err := cd.checkItemTTL(item); err != nil {
+		return err
+	}
+	if !item.hasDo() {
+		_, _, err := cd.set(item)
+		return err
 	}
 
-	if cd.opt.LocalCache != nil && !item.SkipLocalCache {
-		cd.opt.LocalCache.Set(item.Key, b)
+	v, err, _ := cd.group.Do("\x00refresh\x00"+item.Key, func() (interface{}, error) {
+		b, _, err := cd.set(item)
+		return b, err
+	})
+	if err != nil {
+		return err
 	}
 
-	if cd.opt.Redis == nil {
-		if cd.opt.LocalCache == nil {
-			return b, true, errRedisLocalCacheNil
-		}
-		return b, true, nil
+	b := v.([]byte)
+	if item.Value == nil || len(b) == 0 {
+		return nil
 	}
+	return cd.unmarshal(b, item.Value)
+}
 
-	ttl := item.ttl()
-	if ttl == 0 {
-		return b, true, nil
+// minTTL returns the shortest TTL that is not replaced with the default.
+func (cd *Cache) minTTL() time.Duration {
+	if cd.opt.AllowSubSecondTTL {
+		// Redis expiration has millisecond precision.
+		return time.Millisecond
 	}
+	return time.Second
+}
 
-	if item.SetXX {
-		return b, true, cd.opt.Redis.SetXX(item.Context(), item.Key, b, ttl).Err()
+// checkTTL returns ErrMissingTTL if the item would get the default TTL
+// and Options.RequireExplicitTTL is set.
+func (cd *Cache) checkTTL(key string, ttl time.Duration) error {
+	if !cd.opt.RequireExplicitTTL || cd.opt.RedisTTLFunc != nil {
+		return nil
 	}
-	if item.SetNX {
-		return b, true, cd.opt.Redis.SetNX(item.Context(), item.Key, b, ttl).Err()
+	if ttl < 0 || ttl >= cd.minTTL() {
+		return nil
 	}
-	return b, true, cd.opt.Redis.Set(item.Context(), item.Key, b, ttl).Err()
+	return fmt.Errorf("%w for key=%q", ErrMissingTTL, key)
 }
 
-// Exists reports whether value for the given key exists.
-func (cd *Cache) Exists(ctx context.Context, key string) bool {
-	return cd.Get(ctx, key, nil) == nil
+// checkItemTTL is like checkTTL for the item TTL. Items with DoTTL are
+// checked by encode once DoTTL returns the TTL.
+func (cd *Cache) checkItemTTL(item *Item) error {
+	if item.usesDoTTL() {
+		return nil
+	}
+	return cd.checkTTL(item.Key, item.TTL)
 }
 
-// Get gets the value for the given key.
-func (cd *Cache) Get(ctx context.Context, key string, value interface{}) error {
-	return cd.get(ctx, key, value, false)
+// checkKey returns ErrKeyTooLong if the key is longer than
+// Options.MaxKeyLength or the error returned by Options.ValidateKey.
+func (cd *Cache) checkKey(key string) error {
+	if cd.opt.MaxKeyLength > 0 && len(key) > cd.opt.MaxKeyLength {
+		return fmt.Errorf("%w: %d bytes, key=%.64q", ErrKeyTooLong, len(key), key)
+	}
+	if cd.opt.ValidateKey != nil {
+		return cd.opt.ValidateKey(key)
+	}
+	return nil
 }
 
-// Get gets the value for the given key skipping local cache.
-func (cd *Cache) GetSkippingLocalCache(
-	ctx context.Context, key string, value interface{},
-) error {
-	return cd.get(ctx, key, value, true)
+// checkKeys is like checkKey, but returns the error for the first invalid key.
+func (cd *Cache) checkKeys(keys []string) error {
+	if cd.opt.MaxKeyLength <= 0 && cd.opt.ValidateKey == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := cd.checkKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (cd *Cache) get(
-	ctx context.Context,
-	key string,
-	value interface{},
-	skipLocalCache bool,
-) error {
-	b, err := cd.getBytes(ctx, key, skipLocalCache)
+var setCreatedScript = redis.NewScript(`
+local existed = redis.call("EXISTS", KEYS[1])
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+  redis.call("SET", KEYS[1], ARGV[1], "KEEPTTL")
+end
+return existed
+`)
+
+// SetReturningCreated is like Set, but also reports whether the key did not
+// exist before. It checks and sets the key atomically with a Lua script.
+// Without Redis, or for items that are not written to Redis, the local cache
+// is checked instead. SetXX and SetNX are ignored. The side items returned
+// by Do are cached after the item.
+func (cd *Cache) SetReturningCreated(item *Item) (created bool, err error) {
+	if cd.opt.ReadOnly {
+		return false, ErrReadOnly
+	}
+	if err := cd.checkKey(item.Key); err != nil {
+		return false, err
+	}
+	if err := cd.checkItemTTL(item); err != nil {
+		return false, err
+	}
+
+	b, side, ttl, store, err := cd.encode(item)
+	if err != nil || !store {
+		return false, err
+	}
+
+	created, err = cd.setCreated(item.withTTL(ttl), b)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return cd.unmarshal(b, value)
+	if err := cd.setSide(item.Context(), side); err != nil {
+		return false, err
+	}
+	return created, nil
 }
 
-func (cd *Cache) getBytes(ctx context.Context, key string, skipLocalCache bool) ([]byte, error) {
-	if !skipLocalCache && cd.opt.LocalCache != nil {
-		b, ok := cd.opt.LocalCache.Get(key)
-		if ok {
-			return b, nil
-		}
+func (cd *Cache) setCreated(item *Item, b []byte) (bool, error) {
+	rdb := cd.redis(item.Key)
+	if rdb == nil && cd.opt.LocalCache == nil {
+		return false, ErrNoBackend
 	}
 
-	if cd.opt.Redis == nil {
-		if cd.opt.LocalCache == nil {
-			return nil, errRedisLocalCacheNil
-		}
-		return nil, ErrCacheMiss
+	var ttl time.Duration
+	if rdb != nil {
+		ttl = cd.redisTTL(item)
 	}
-
-	b, err := cd.opt.Redis.Get(ctx, key).Bytes()
-	if err != nil {
-		if cd.opt.StatsEnabled {
-			atomic.AddUint64(&cd.misses, 1)
+	if rdb == nil || (ttl == 0 && !item.KeepTTL) {
+		// The item is only cached locally.
+		var existed bool
+		if cd.opt.LocalCache != nil {
+			_, existed = cd.opt.LocalCache.Get(item.Key)
 		}
-		if err == redis.Nil {
-			return nil, ErrCacheMiss
+		if !item.SkipLocalCache {
+			cd.setLocalOnWrite(item.Key, b)
 		}
-		return nil, err
+		return cd.opt.LocalCache != nil && !existed, nil
 	}
 
-	if cd.opt.StatsEnabled {
-		atomic.AddUint64(&cd.hits, 1)
+	if !item.SkipLocalCache {
+		cd.setLocalOnWrite(item.Key, b)
 	}
-
-	if !skipLocalCache && cd.opt.LocalCache != nil {
-		cd.opt.LocalCache.Set(key, b)
+	if item.KeepTTL {
+		ttl = 0
 	}
-	return b, nil
-}
 
-// Once gets the item.Value for the given item.Key from the cache or
-// executes, caches, and returns the results of the given item.Func,
-// making sure that only one execution is in-flight for a given item.Key
-// at a time. If a duplicate comes in, the duplicate caller waits for the
-// original to complete and receives the same results.
-func (cd *Cache) Once(item *Item) error {
-	b, cached, err := cd.getSetItemBytesOnce(item)
+	existed, err := setCreatedScript.Run(
+		item.Context(), rdb, []string{item.Key}, b, ttl.Milliseconds()).Int64()
 	if err != nil {
-		return err
+		return false, err
 	}
+	return existed == 0, nil
+}
 
-	if item.Value == nil || len(b) == 0 {
-		return nil
+// value returns the item value and limits the number of concurrent Do
+// calls when Options.MaxConcurrentFuncs is set.
+func (cd *Cache) value(item *Item) (interface{}, time.Duration, error) {
+	if item.hasDo() && cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("once", "do", time.Now())
+	}
+	if !item.hasDo() || cd.funcSem == nil || cd.holdsFuncSem(item.Context()) {
+		return item.value(cd.minTTL())
 	}
 
-	if err := cd.unmarshal(b, item.Value); err != nil {
-		if cached {
-			_ = cd.Delete(item.Context(), item.Key)
-			return cd.Once(item)
-		}
-		return err
+	select {
+	case cd.funcSem <- struct{}{}:
+	case <-item.Context().Done():
+		return nil, 0, item.Context().Err()
 	}
+	defer func() { <-cd.funcSem }()
 
-	return nil
+	// Once and OnceBatch calls made by Do with the item context run in
+	// the slot that is already held instead of waiting for another one.
+	ctx := item.Ctx
+	item.Ctx = context.WithValue(item.Context(), funcSemKey{}, cd.funcSem)
+	defer func() { item.Ctx = ctx }()
+
+	return item.value(cd.minTTL())
 }
 
-func (cd *Cache) getSetItemBytesOnce(item *Item) (b []byte, cached bool, err error) {
-	if cd.opt.LocalCache != nil {
-		b, ok := cd.opt.LocalCache.Get(item.Key)
-		if ok {
-			return b, true, nil
-		}
-	}
+type funcSemKey struct{}
 
-	v, err, _ := cd.group.Do(item.Key, func() (interface{}, error) {
-		b, err := cd.getBytes(item.Context(), item.Key, item.SkipLocalCache)
-		if err == nil {
-			cached = true
-			return b, nil
-		}
+// holdsFuncSem reports whether ctx belongs to a Do call that holds an
+// Options.MaxConcurrentFuncs slot of the cache.
+func (cd *Cache) holdsFuncSem(ctx context.Context) bool {
+	sem, _ := ctx.Value(funcSemKey{}).(chan struct{})
+	return cd.funcSem != nil && sem == cd.funcSem
+}
 
-		b, ok, err := cd.set(item)
-		if ok {
-			return b, nil
-		}
-		return nil, err
-	})
+func (cd *Cache) set(item *Item) ([]byte, bool, error) {
+	b, side, ttl, store, err := cd.encode(item)
 	if err != nil {
 		return nil, false, err
 	}
-	return v.([]byte), cached, nil
+	if !store {
+		return b, true, nil
+	}
+	return b, true, cd.setBytesWithSide(item.withTTL(ttl), b, side)
 }
 
-func (cd *Cache) Delete(ctx context.Context, key string) error {
-	if cd.opt.LocalCache != nil {
-		cd.opt.LocalCache.Del(key)
+// encode returns the encoded item value, the side items returned by Do,
+// the TTL returned by DoTTL and whether they should be cached.
+func (cd *Cache) encode(item *Item) ([]byte, []*Item, time.Duration, bool, error) {
+	value, ttl, err := cd.value(item)
+	skip := err == ErrSkipCache
+	if err != nil && !skip {
+		return nil, nil, 0, false, err
+	}
+	if item.usesDoTTL() {
+		if err := cd.checkTTL(item.Key, item.withTTL(ttl).TTL); err != nil {
+			return nil, nil, 0, false, err
+		}
 	}
 
-	if cd.opt.Redis == nil {
-		if cd.opt.LocalCache == nil {
-			return errRedisLocalCacheNil
+	var side []*Item
+	if sv, ok := value.(*SideValues); ok {
+		value, side = sv.Value, sv.Items
+		for _, sideItem := range side {
+			if err := cd.checkKey(sideItem.Key); err != nil {
+				return nil, nil, 0, false, err
+			}
+			if err := cd.checkItemTTL(sideItem); err != nil {
+				return nil, nil, 0, false, err
+			}
+			if sideItem.Value == nil && cd.opt.RejectNilValue {
+				return nil, nil, 0, false, fmt.Errorf("%w for key=%q", ErrNilValue, sideItem.Key)
+			}
 		}
-		return nil
 	}
 
-	_, err := cd.opt.Redis.Del(ctx, key).Result()
-	return err
-}
+	if value == nil && cd.opt.RejectNilValue {
+		return nil, nil, 0, false, fmt.Errorf("%w for key=%q", ErrNilValue, item.Key)
+	}
+
+	b, err := cd.marshalKey(item.Key, value, item.Compress)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	if item.Version != 0 {
+		b = setVersion(b, item.Version)
+	}
+
+	if skip || (item.MaxSize > 0 && len(b) > item.MaxSize) {
+		return b, nil, ttl, false, nil
+	}
+	return b, side, ttl, true, nil
+}
+
+// setBytes caches the encoded value for the item.
+func (cd *Cache) setBytes(item *Item, b []byte) error {
+	unchanged := cd.opt.SkipUnchangedWrites && cd.localEqual(item, b)
+
+	if !item.SkipLocalCache {
+		cd.setLocalOnWrite(item.Key, b)
+	}
+
+	if cd.opt.ReadOnly {
+		return nil
+	}
+
+	rdb := cd.redis(item.Key)
+	if rdb == nil {
+		if cd.opt.LocalCache == nil {
+			return ErrNoBackend
+		}
+		return nil
+	}
+
+	ttl := cd.redisTTL(item)
+	if ttl == 0 {
+		return nil
+	}
+	if item.KeepTTL {
+		ttl = redis.KeepTTL
+	}
+
+	if cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("set", "redis", time.Now())
+	}
+
+	if unchanged {
+		// Only refresh the TTL, unless the key is gone from Redis.
+		ok, err := rdb.PExpire(item.Context(), item.Key, ttl).Result()
+		if err != nil || ok {
+			return err
+		}
+	}
+
+	if item.SetXX {
+		return rdb.SetXX(item.Context(), item.Key, b, ttl).Err()
+	}
+	if item.SetNX {
+		return rdb.SetNX(item.Context(), item.Key, b, ttl).Err()
+	}
+	return rdb.Set(item.Context(), item.Key, b, ttl).Err()
+}
+
+// localEqual reports whether the local cache already holds b for the item.
+// SetXX, SetNX and KeepTTL items are never considered equal, because their
+// result depends on Redis.
+func (cd *Cache) localEqual(item *Item, b []byte) bool {
+	if cd.opt.LocalCache == nil || item.SkipLocalCache ||
+		item.SetXX || item.SetNX || item.KeepTTL {
+		return false
+	}
+	old, ok := cd.opt.LocalCache.Get(item.Key)
+	return ok && bytes.Equal(old, b)
+}
+
+// setLocalOnWrite stores a value written to Redis in the local cache, or
+// deletes the old local value when Options.SkipLocalCacheOnSet is set.
+func (cd *Cache) setLocalOnWrite(key string, b []byte) {
+	if cd.opt.LocalCache == nil {
+		return
+	}
+	if cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("set", "local", time.Now())
+	}
+	if cd.opt.SkipLocalCacheOnSet {
+		cd.opt.LocalCache.Del(key)
+		return
+	}
+	cd.setLocal(key, b)
+}
+
+// setLocal stores the encoded value in the local cache unless it is larger
+// than Options.MaxLocalSize, in which case the stale entry is deleted.
+func (cd *Cache) setLocal(key string, b []byte) {
+	if cd.opt.MaxLocalSize > 0 && len(b) > cd.opt.MaxLocalSize {
+		cd.opt.LocalCache.Del(key)
+		return
+	}
+	cd.opt.LocalCache.Set(key, b)
+}
+
+// setLocalMany is a batch version of setLocal that uses SetMany when the
+// local cache implements it.
+func (cd *Cache) setLocalMany(keys []string, values [][]byte) {
+	local, ok := cd.opt.LocalCache.(manySetter)
+	if !ok {
+		for i, key := range keys {
+			cd.setLocal(key, values[i])
+		}
+		return
+	}
+
+	if cd.opt.MaxLocalSize > 0 {
+		var setKeys []string
+		var setValues [][]byte
+		for i, key := range keys {
+			if len(values[i]) > cd.opt.MaxLocalSize {
+				cd.opt.LocalCache.Del(key)
+				continue
+			}
+			setKeys = append(setKeys, key)
+			setValues = append(setValues, values[i])
+		}
+		keys, values = setKeys, setValues
+	}
+	if len(keys) > 0 {
+		local.SetMany(keys, values)
+	}
+}
+
+// redisTTL returns the Redis TTL for the item. Items without a TTL use
+// Options.RedisTTLFunc when it is set and the local cache reports its TTL.
+// Zero means that the item is not written to Redis.
+func (cd *Cache) redisTTL(item *Item) time.Duration {
+	var ttl time.Duration
+	if item.TTL == 0 && cd.opt.RedisTTLFunc != nil && cd.localTTL > 0 {
+		ttl = cd.opt.RedisTTLFunc(cd.localTTL)
+	} else {
+		ttl = item.ttl(cd.minTTL())
+	}
+
+	if item.CapTTLToDeadline && ttl > 0 {
+		if deadline, ok := item.Context().Deadline(); ok {
+			if left := time.Until(deadline); left < ttl {
+				// Redis expiration has millisecond precision.
+				if left < time.Millisecond {
+					return 0
+				}
+				ttl = left
+			}
+		}
+	}
+	return ttl
+}
+
+// GetSet atomically replaces the value for the given key and decodes the
+// previous value into oldValue. GETSET discards the key TTL, so it is set
+// again with PEXPIRE using the same defaults as Item.TTL; a negative ttl
+// leaves the key without expiration. If the key did not exist, the new value
+// is still stored and ErrCacheMiss is returned.
+func (cd *Cache) GetSet(
+	ctx context.Context, key string, value, oldValue interface{}, ttl time.Duration,
+) error {
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+	if err := cd.checkTTL(key, ttl); err != nil {
+		return err
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return ErrNoRedis
+	}
+
+	b, err := cd.marshalKey(key, value, nil)
+	if err != nil {
+		return err
+	}
+
+	old, err := rdb.GetSet(ctx, key, b).Bytes()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	miss := err == redis.Nil
+
+	item := &Item{Key: key, TTL: ttl}
+	if ttl := cd.redisTTL(item); ttl > 0 {
+		if err := rdb.PExpire(ctx, key, ttl).Err(); err != nil {
+			return err
+		}
+	}
+
+	cd.setLocalOnWrite(key, b)
+
+	if miss {
+		return ErrCacheMiss
+	}
+	return cd.unmarshal(old, oldValue)
+}
+
+var takeScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if v then
+  redis.call("DEL", KEYS[1])
+end
+return v
+`)
+
+// Take atomically gets and deletes the value for the given key, e.g. for
+// single-use tokens, so concurrent callers can't both receive it. The key is
+// also deleted from the local cache, but the value is always read from Redis.
+// A missing key is reported as ErrCacheMiss.
+func (cd *Cache) Take(ctx context.Context, key string, value interface{}) error {
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return ErrNoRedis
+	}
+
+	if cd.opt.LocalCache != nil {
+		cd.opt.LocalCache.Del(key)
+	}
+
+	s, err := takeScript.Run(ctx, rdb, []string{key}).Text()
+	if err == redis.Nil || (err == nil && s == "" && cd.opt.EmptyAsMiss) {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+	return cd.unmarshal([]byte(s), value)
+}
+
+// Exists reports whether value for the given key exists.
+func (cd *Cache) Exists(ctx context.Context, key string) bool {
+	return cd.Get(ctx, key, nil) == nil
+}
+
+var decrementFloorScript = redis.NewScript(`
+local n = redis.call("GET", KEYS[1])
+if n then
+  n = tonumber(n)
+  if not n then
+    return redis.error_reply("ERR value is not an integer")
+  end
+else
+  n = 0
+end
+
+n = n - tonumber(ARGV[1])
+local floor = tonumber(ARGV[2])
+if n < floor then
+  n = floor
+end
+
+if tonumber(ARGV[3]) > 0 then
+  redis.call("SET", KEYS[1], n, "PX", ARGV[3])
+else
+  redis.call("SET", KEYS[1], n)
+end
+return n
+`)
+
+// DecrementFloor atomically decrements the integer value of the key by delta
+// without going below floor and returns the new value. A missing key counts
+// as 0. The value is stored as a decimal string, like the one used by INCR,
+// and ttl follows the same defaults as Item.TTL.
+func (cd *Cache) DecrementFloor(
+	ctx context.Context, key string, delta, floor int64, ttl time.Duration,
+) (int64, error) {
+	if cd.opt.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := cd.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := cd.checkTTL(key, ttl); err != nil {
+		return 0, err
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return 0, ErrNoRedis
+	}
+
+	item := &Item{Key: key, TTL: ttl}
+	n, err := decrementFloorScript.Run(
+		ctx, rdb, []string{key}, delta, floor, cd.redisTTL(item).Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	cd.setLocalOnWrite(key, strconv.AppendInt(nil, n, 10))
+	return n, nil
+}
+
+// ExistsMany reports which of the given keys exist. Keys found in the local
+// cache are not looked up in Redis. The rest are checked with a pipeline of
+// EXISTS commands per shard, because EXISTS with several keys only returns
+// how many of them exist.
+func (cd *Cache) ExistsMany(ctx context.Context, keys []string) (map[string]bool, error) {
+	if len(cd.shards) == 0 && cd.opt.LocalCache == nil {
+		return nil, ErrNoBackend
+	}
+	if err := cd.checkKeys(keys); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]bool, len(keys))
+	var remaining []string
+	for _, key := range keys {
+		if cd.opt.LocalCache != nil {
+			if _, ok := cd.opt.LocalCache.Get(key); ok {
+				m[key] = true
+				continue
+			}
+		}
+		m[key] = false
+		remaining = append(remaining, key)
+	}
+
+	if len(remaining) == 0 || len(cd.shards) == 0 {
+		return m, nil
+	}
+
+	for shard, idxs := range cd.groupByShard(remaining) {
+		if len(idxs) == 0 {
+			continue
+		}
+
+		cmds, err := cd.shards[shard].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range idxs {
+				pipe.Exists(ctx, remaining[i])
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for j, cmd := range cmds {
+			m[remaining[idxs[j]]] = cmd.(*redis.IntCmd).Val() > 0
+		}
+	}
+
+	return m, nil
+}
+
+// MissingKeys returns the keys that are present in neither the local cache
+// nor Redis, in the order they are given, e.g. to load only those in a
+// batch. Like ExistsMany, it does not fetch the values.
+func (cd *Cache) MissingKeys(ctx context.Context, keys []string) ([]string, error) {
+	exists, err := cd.ExistsMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if !exists[key] {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// Get gets the value for the given key. If the key holds a cached nil value,
+// Get returns a nil error and leaves value unchanged; a missing key is
+// reported as ErrCacheMiss. Decoded values, including byte slices, never
+// share memory with the local cache and can be modified by the caller.
+func (cd *Cache) Get(ctx context.Context, key string, value interface{}) error {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("get", key, time.Now())
+	}
+	return cd.get(ctx, key, value, false)
+}
+
+// Get gets the value for the given key skipping local cache.
+func (cd *Cache) GetSkippingLocalCache(
+	ctx context.Context, key string, value interface{},
+) error {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("get", key, time.Now())
+	}
+	return cd.get(ctx, key, value, true)
+}
+
+// GetAllowStale is like Get, but when Redis returns an error it decodes the
+// expired local value, if any, and reports it as stale instead of returning
+// the error. It works regardless of Options.ServeStaleOnRedisError and
+// requires a LocalCache with a GetStale(key string) ([]byte, bool) method,
+// like TinyLFU, to serve stale values.
+func (cd *Cache) GetAllowStale(
+	ctx context.Context, key string, value interface{},
+) (stale bool, err error) {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("get", key, time.Now())
+	}
+	if err := cd.checkKey(key); err != nil {
+		return false, err
+	}
+
+	b, stale, err := cd.getBytesStale(ctx, key, false, true)
+	if err != nil {
+		return false, err
+	}
+	return stale, cd.unmarshal(b, value)
+}
+
+// GetWithTTL is like GetSkippingLocalCache, but also returns the remaining
+// Redis TTL of the key, which is negative for keys without expiration. The
+// value and the TTL are read with a single pipeline of GET and PTTL, since
+// the Redis client does not support RESP3 attributes that would carry the TTL
+// with the value. It requires Redis.
+func (cd *Cache) GetWithTTL(
+	ctx context.Context, key string, value interface{},
+) (time.Duration, error) {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("get", key, time.Now())
+	}
+	if err := cd.checkKey(key); err != nil {
+		return 0, err
+	}
+	if bypassed(ctx) {
+		return 0, ErrCacheMiss
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return 0, ErrNoRedis
+	}
+
+	b, ttl, err := cd.redisGetWithTTL(ctx, rdb, key)
+	if err != nil {
+		cd.countReadError(ctx, err)
+		if err == redis.Nil {
+			cd.onMiss(key)
+			return 0, ErrCacheMiss
+		}
+		return 0, err
+	}
+
+	if cd.statsEnabled(ctx) {
+		atomic.AddUint64(&cd.hits, 1)
+	}
+
+	if cd.opt.ReadTransform != nil {
+		b, err = cd.readTransform(ctx, key, b, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := cd.cachedError(b); err != nil {
+		return 0, err
+	}
+	if err := cd.unmarshal(b, value); err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+func (cd *Cache) get(
+	ctx context.Context,
+	key string,
+	value interface{},
+	skipLocalCache bool,
+) error {
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+
+	b, err := cd.getBytes(ctx, key, skipLocalCache)
+	if err == ErrCacheMiss && cd.opt.UnifiedSingleFlight && !bypassed(ctx) {
+		b, err = cd.waitFlight(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := cd.cachedError(b); err != nil {
+		return err
+	}
+	return cd.unmarshal(b, value)
+}
+
+func (cd *Cache) getBytes(ctx context.Context, key string, skipLocalCache bool) ([]byte, error) {
+	b, _, err := cd.getBytesStale(ctx, key, skipLocalCache, cd.opt.ServeStaleOnRedisError)
+	return b, err
+}
+
+// getBytesStale is like getBytes, but also reports whether an expired
+// local value is served because Redis failed, which requires serveStale.
+func (cd *Cache) getBytesStale(
+	ctx context.Context, key string, skipLocalCache, serveStale bool,
+) ([]byte, bool, error) {
+	b, stale, err := cd.lookupBytes(ctx, key, skipLocalCache, serveStale)
+	if err != nil || cd.opt.ReadTransform == nil {
+		return b, stale, err
+	}
+
+	b, err = cd.readTransform(ctx, key, b, !stale)
+	return b, stale, err
+}
+
+// readTransform applies Options.ReadTransform to the value read for the key
+// and, if writeBack is set, caches the transformed value keeping the TTL.
+func (cd *Cache) readTransform(ctx context.Context, key string, b []byte, writeBack bool) ([]byte, error) {
+	transformed, err := cd.opt.ReadTransform(key, b)
+	if err != nil {
+		return nil, err
+	}
+	if transformed == nil {
+		return b, nil
+	}
+
+	if writeBack && !cd.opt.ReadOnly {
+		// SetXX does not recreate a key that expired in Redis
+		// while the value was still cached locally.
+		if err := cd.setBytes(&Item{
+			Ctx:     ctx,
+			Key:     key,
+			KeepTTL: true,
+			SetXX:   true,
+		}, transformed); err != nil && err != redis.Nil {
+			cd.onError(fmt.Errorf("cache: writing back transformed value for key=%q: %w", key, err))
+		}
+	}
+	return transformed, nil
+}
+
+func (cd *Cache) lookupBytes(
+	ctx context.Context, key string, skipLocalCache, serveStale bool,
+) ([]byte, bool, error) {
+	if bypassed(ctx) {
+		return nil, false, ErrCacheMiss
+	}
+
+	useLocal := !skipLocalCache && cd.opt.LocalCache != nil
+	rdb := cd.redis(key)
+	redisFirst := cd.redisFirst(key)
+
+	if useLocal && !redisFirst {
+		b, ok := cd.localGet(key)
+		if ok {
+			if cd.opt.ReadRepairRate > 0 && rand.Float64() < cd.opt.ReadRepairRate {
+				b, err := cd.readRepair(ctx, key, b)
+				return b, false, err
+			}
+			return b, false, nil
+		}
+	}
+
+	if rdb == nil {
+		if cd.opt.LocalCache == nil {
+			return nil, false, ErrNoBackend
+		}
+		cd.onMiss(key)
+		return nil, false, ErrCacheMiss
+	}
+
+	b, err := cd.redisGet(ctx, rdb, key)
+	if err != nil {
+		cd.countReadError(ctx, err)
+		if err == redis.Nil {
+			cd.onMiss(key)
+			return nil, false, ErrCacheMiss
+		}
+		if useLocal && redisFirst {
+			if b, ok := cd.opt.LocalCache.Get(key); ok {
+				cd.onError(fmt.Errorf("cache: serving local value for key=%q: %w", key, err))
+				return b, false, nil
+			}
+		}
+		if useLocal && serveStale {
+			if b, ok := cd.getStale(key); ok {
+				cd.onError(fmt.Errorf("cache: serving stale local value for key=%q: %w", key, err))
+				return b, true, nil
+			}
+		}
+		return nil, false, err
+	}
+
+	if cd.statsEnabled(ctx) {
+		atomic.AddUint64(&cd.hits, 1)
+	}
+
+	if useLocal {
+		cd.setLocal(key, b)
+	}
+	return b, false, nil
+}
+
+// Peek is like Get, but it does not update the stats, call OnMiss or store
+// the Redis value in the local cache, so health checks and debug reads don't
+// skew the hit ratio.
+func (cd *Cache) Peek(ctx context.Context, key string, value interface{}) error {
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+
+	b, err := cd.peekBytes(ctx, key)
+	if err != nil {
+		return err
+	}
+	return cd.unmarshal(b, value)
+}
+
+// RedisBytes returns the bytes Redis holds for the key as they are stored,
+// without decoding them, reading the local cache or storing them in it, e.g.
+// to verify the Redis contents after a migration.
+func (cd *Cache) RedisBytes(ctx context.Context, key string) ([]byte, error) {
+	if err := cd.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return nil, ErrNoRedis
+	}
+
+	b, err := rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+// redisFirst reports whether Redis is checked before the local cache
+// for the key.
+func (cd *Cache) redisFirst(key string) bool {
+	return cd.opt.ReadOrder == RedisFirst && cd.redis(key) != nil
+}
+
+func (cd *Cache) peekBytes(ctx context.Context, key string) ([]byte, error) {
+	if cd.opt.LocalCache != nil {
+		b, ok := cd.opt.LocalCache.Get(key)
+		if ok {
+			return b, nil
+		}
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		if cd.opt.LocalCache == nil {
+			return nil, ErrNoBackend
+		}
+		return nil, ErrCacheMiss
+	}
+
+	b, err := cd.redisBytes(rdb.Get(ctx, key))
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+func (cd *Cache) getStale(key string) ([]byte, bool) {
+	local, ok := cd.opt.LocalCache.(staleGetter)
+	if !ok {
+		return nil, false
+	}
+	return local.GetStale(key)
+}
+
+// redisGet gets the value from Redis within Options.ReadTimeout.
+func (cd *Cache) redisGet(ctx context.Context, rdb Rediser, key string) ([]byte, error) {
+	if cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("get", "redis", time.Now())
+	}
+	if cd.opt.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cd.opt.ReadTimeout)
+		defer cancel()
+	}
+	return cd.redisBytes(rdb.Get(ctx, key))
+}
+
+// redisGetWithTTL is like redisGet, but also returns the PTTL of the key.
+// Both are read with a single pipeline.
+func (cd *Cache) redisGetWithTTL(
+	ctx context.Context, rdb Rediser, key string,
+) ([]byte, time.Duration, error) {
+	if cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("get", "redis", time.Now())
+	}
+	if cd.opt.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cd.opt.ReadTimeout)
+		defer cancel()
+	}
+
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	b, err := cd.redisBytes(get)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, pttl.Val(), nil
+}
+
+// localGet is LocalCache.Get that reports its latency.
+func (cd *Cache) localGet(key string) ([]byte, bool) {
+	if cd.opt.ObserveLatency != nil {
+		defer cd.observeLatency("get", "local", time.Now())
+	}
+	return cd.opt.LocalCache.Get(key)
+}
+
+// redisBytes returns the value of a GET command. Empty values are reported
+// as redis.Nil when Options.EmptyAsMiss is set.
+func (cd *Cache) redisBytes(cmd *redis.StringCmd) ([]byte, error) {
+	b, err := cmd.Bytes()
+	if err == nil && len(b) == 0 && cd.opt.EmptyAsMiss {
+		return nil, redis.Nil
+	}
+	return b, err
+}
+
+// readRepair compares the local value with Redis and replaces or drops the
+// local entry when they differ. Redis errors are ignored and the local value
+// is served.
+func (cd *Cache) readRepair(ctx context.Context, key string, local []byte) ([]byte, error) {
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return local, nil
+	}
+
+	b, err := cd.redisBytes(rdb.Get(ctx, key))
+	if err != nil {
+		if err != redis.Nil {
+			return local, nil
+		}
+		cd.opt.LocalCache.Del(key)
+		cd.onError(fmt.Errorf("%w: key=%q is missing in Redis", ErrLocalCacheMismatch, key))
+		cd.onMiss(key)
+		return nil, ErrCacheMiss
+	}
+
+	if !bytes.Equal(b, local) {
+		cd.setLocal(key, b)
+		cd.onError(fmt.Errorf("%w: key=%q", ErrLocalCacheMismatch, key))
+	}
+	return b, nil
+}
+
+// Once gets the item.Value for the given item.Key from the cache or
+// executes, caches, and returns the results of the given item.Func,
+// making sure that only one execution is in-flight for a given item.Key
+// at a time. If a duplicate comes in, the duplicate caller waits for the
+// original to complete and receives the same results.
+//
+// The local cache acts as L1: it is checked before joining the in-flight
+// call and again inside it, and the computed value is stored locally before
+// the call completes. So within one process concurrent calls for a cold key
+// do a single Redis read and a single item.Do call.
+func (cd *Cache) Once(item *Item) error {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("once", item.Key, time.Now())
+	}
+	if err := cd.checkKey(item.Key); err != nil {
+		return err
+	}
+	if err := cd.checkItemTTL(item); err != nil {
+		return err
+	}
+	if cd.hotKeys != nil {
+		cd.hotKeys.record(item.Key)
+	}
+
+	for attempt := 0; ; attempt++ {
+		b, cached, err := cd.getSetItemBytesOnce(item)
+		if err != nil {
+			return err
+		}
+		if err := cd.cachedError(b); err != nil {
+			return err
+		}
+
+		if item.Value == nil || len(b) == 0 {
+			return nil
+		}
+
+		err = cd.unmarshal(b, item.Value)
+		if err == nil {
+			return nil
+		}
+		// A cached value that can't be decoded is deleted and recomputed,
+		// but the cache may keep returning it, e.g. when another process
+		// writes it back, so give up after a few attempts.
+		if !cached || attempt >= onceMaxRetries {
+			return err
+		}
+
+		_ = cd.Delete(item.Context(), item.Key)
+
+		if err := sleepJitter(item.Context(), onceRetryBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepJitter sleeps for a random duration up to max or until ctx is done.
+func sleepJitter(ctx context.Context, max time.Duration) error {
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(max))))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cd *Cache) getSetItemBytesOnce(item *Item) (b []byte, cached bool, err error) {
+	bypass := bypassed(item.Context())
+	if cd.opt.LocalCache != nil && !item.SkipLocalCache && !cd.redisFirst(item.Key) && !bypass {
+		b, ok := cd.opt.LocalCache.Get(item.Key)
+		if ok && cd.opt.ReadTransform != nil {
+			b, err = cd.readTransform(item.Context(), item.Key, b, true)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		if ok && versionMatches(b, item.Version) {
+			return b, true, nil
+		}
+	}
+
+	groupKey := item.GroupKey
+	if groupKey == "" {
+		groupKey = item.Key
+	}
+	if bypass {
+		// Don't share the cached value of a concurrent call.
+		groupKey = "\x00bypass\x00" + groupKey
+	}
+
+	var leader bool
+	v, err, _ := cd.group.Do(groupKey, func() (_ interface{}, err error) {
+		leader = true
+		if cd.opt.RecoverFunc {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("cache: Do for key=%q panicked: %v\n%s",
+						item.Key, r, debug.Stack())
+				}
+			}()
+		}
+		if cd.opt.UnifiedSingleFlight && !bypass {
+			defer cd.startFlight(item.Key)()
+		}
+
+		ctx := item.Context()
+		if item.SkipStats {
+			ctx = WithoutStats(ctx)
+		}
+
+		b, err := cd.getBytes(ctx, item.Key, item.SkipLocalCache)
+		if err == nil && versionMatches(b, item.Version) {
+			cached = true
+			return &onceValue{key: item.Key, b: b, store: true}, nil
+		}
+
+		b, side, ttl, store, err := cd.encode(item)
+		if err != nil {
+			if b, ok := cd.marshalError(item, err); ok {
+				_ = cd.setBytes(cd.negativeItem(item), b)
+				return &onceValue{key: item.Key, b: b, store: true}, nil
+			}
+			if !item.hasDo() || item.Fallback == nil || errors.Is(err, ErrMissingTTL) {
+				return nil, err
+			}
+			return cd.fallback(item, err)
+		}
+		if store {
+			_ = cd.setBytesWithSide(item.withTTL(ttl), b, side)
+		}
+		return &onceValue{key: item.Key, b: b, ttl: ttl, store: store}, nil
+	})
+	if !item.SkipStats && cd.statsEnabled(item.Context()) {
+		if leader {
+			atomic.AddUint64(&cd.computed, 1)
+		} else {
+			atomic.AddUint64(&cd.shared, 1)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	res := v.(*onceValue)
+	if res.key != item.Key && res.store {
+		// The value was computed for another key of the group.
+		_ = cd.setBytes(item.withTTL(res.ttl), res.b)
+	}
+	return res.b, cached, nil
+}
+
+// fallback encodes the Fallback of the item which Do failed to compute.
+func (cd *Cache) fallback(item *Item, doErr error) (*onceValue, error) {
+	cd.onError(fmt.Errorf("cache: Do for key=%q failed, returning Fallback: %w", item.Key, doErr))
+
+	b, err := cd.marshalKey(item.Key, item.Fallback, item.Compress)
+	if err != nil {
+		return nil, err
+	}
+
+	if item.FallbackTTL > 0 {
+		cp := *item
+		cp.TTL = item.FallbackTTL
+		_ = cd.setBytes(&cp, b)
+	}
+	// Other keys of the group don't cache the Fallback with their TTL.
+	return &onceValue{key: item.Key, b: b}, nil
+}
+
+// negativeItem returns the item to cache an error for,
+// which uses Options.NegativeTTL when it is set.
+func (cd *Cache) negativeItem(item *Item) *Item {
+	if cd.opt.NegativeTTL == 0 {
+		return item
+	}
+	cp := *item
+	cp.TTL = cd.opt.NegativeTTL
+	return &cp
+}
+
+// startFlight registers that Once computes the value for the key, so Get
+// can wait for it. The returned func ends the flight.
+func (cd *Cache) startFlight(key string) func() {
+	cd.flightsMu.Lock()
+	defer cd.flightsMu.Unlock()
+
+	if _, ok := cd.flights[key]; ok {
+		// Another group computes the key.
+		return func() {}
+	}
+	if cd.flights == nil {
+		cd.flights = make(map[string]chan struct{})
+	}
+
+	done := make(chan struct{})
+	cd.flights[key] = done
+	return func() {
+		cd.flightsMu.Lock()
+		delete(cd.flights, key)
+		cd.flightsMu.Unlock()
+		close(done)
+	}
+}
+
+// waitFlight waits for the Once call that computes the value for the key,
+// if any, and reads the value it cached. The read is not counted in the
+// stats, which already count the miss.
+func (cd *Cache) waitFlight(ctx context.Context, key string) ([]byte, error) {
+	cd.flightsMu.Lock()
+	done, ok := cd.flights[key]
+	cd.flightsMu.Unlock()
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return cd.peekBytes(ctx, key)
+}
+
+// onceValue is the result of a Once call shared by the items of a group.
+type onceValue struct {
+	key   string
+	b     []byte
+	ttl   time.Duration
+	store bool
+}
+
+func (cd *Cache) Delete(ctx context.Context, key string) error {
+	if cd.opt.SlowThreshold > 0 {
+		defer cd.trackSlow("delete", key, time.Now())
+	}
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+
+	if cd.opt.LocalCache != nil {
+		cd.opt.LocalCache.Del(key)
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		if cd.opt.LocalCache == nil {
+			return ErrNoBackend
+		}
+		return nil
+	}
+
+	_, err := rdb.Del(ctx, key).Result()
+	return err
+}
 
 func (cd *Cache) DeleteFromLocalCache(key string) {
 	if cd.opt.LocalCache != nil {
@@ -324,26 +2073,212 @@ func (cd *Cache) DeleteFromLocalCache(key string) {
 	}
 }
 
+// DeleteFromLocalCacheByPrefix deletes the local entries with keys that
+// start with the prefix, e.g. when a pub/sub message reports that an entity
+// changed. Redis is not changed. It requires a LocalCache with a
+// DelPrefix(prefix string) method, like TinyLFU with Options.LocalKeyIndex.
+func (cd *Cache) DeleteFromLocalCacheByPrefix(prefix string) error {
+	local, ok := cd.opt.LocalCache.(prefixDeleter)
+	if !ok {
+		return errors.New("cache: LocalCache does not support deleting by prefix")
+	}
+	if _, ok := cd.opt.LocalCache.(keyIndexSetter); ok && !cd.opt.LocalKeyIndex {
+		return errors.New("cache: deleting by prefix requires Options.LocalKeyIndex")
+	}
+	local.DelPrefix(prefix)
+	return nil
+}
+
+// Size returns the size of the encoded, and possibly compressed, value
+// stored for the given key. The local cache holds the same bytes as Redis,
+// so it is used when it has the key. Redis can't tell a missing key from
+// an empty value, so both are reported as ErrCacheMiss.
+func (cd *Cache) Size(ctx context.Context, key string) (int, error) {
+	if err := cd.checkKey(key); err != nil {
+		return 0, err
+	}
+
+	if cd.opt.LocalCache != nil {
+		if b, ok := cd.opt.LocalCache.Get(key); ok {
+			return len(b), nil
+		}
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		if cd.opt.LocalCache == nil {
+			return 0, ErrNoBackend
+		}
+		return 0, ErrCacheMiss
+	}
+
+	n, err := rdb.StrLen(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrCacheMiss
+	}
+	return int(n), nil
+}
+
+// RawLocal returns a copy of the encoded value stored in the local cache
+// for the given key and whether the key is present. It does not contact
+// Redis or update the stats.
+func (cd *Cache) RawLocal(key string) ([]byte, bool) {
+	if cd.opt.LocalCache == nil || cd.checkKey(key) != nil {
+		return nil, false
+	}
+
+	b, ok := cd.opt.LocalCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	clone := make([]byte, len(b))
+	copy(clone, b)
+	return clone, true
+}
+
+// Age returns how long ago the value for the given key was stored in the
+// local cache. Redis does not keep the write time, so values that are only
+// in Redis are reported as ErrAgeUnknown. It requires a LocalCache with an
+// Age(key string) (time.Duration, bool) method, like TinyLFU.
+func (cd *Cache) Age(ctx context.Context, key string) (time.Duration, error) {
+	if err := cd.checkKey(key); err != nil {
+		return 0, err
+	}
+
+	local, ok := cd.opt.LocalCache.(ager)
+	if !ok {
+		return 0, errors.New("cache: LocalCache does not report age")
+	}
+
+	if age, ok := local.Age(key); ok {
+		return age, nil
+	}
+
+	rdb := cd.redis(key)
+	if rdb == nil {
+		return 0, ErrCacheMiss
+	}
+	n, err := rdb.Exists(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrCacheMiss
+	}
+	return 0, ErrAgeUnknown
+}
+
+// TouchLocal restarts the local TTL of the entry for the given key. It uses
+// the Touch(key string) bool method of the LocalCache, like TinyLFU, which
+// keeps Options.LocalMaxAge counting from when the entry was set, and sets
+// the entry again otherwise. It does not contact Redis and reports whether
+// the key was present in the local cache.
+func (cd *Cache) TouchLocal(key string) bool {
+	if cd.opt.LocalCache == nil || cd.checkKey(key) != nil {
+		return false
+	}
+	if local, ok := cd.opt.LocalCache.(toucher); ok {
+		return local.Touch(key)
+	}
+
+	b, ok := cd.opt.LocalCache.Get(key)
+	if !ok {
+		return false
+	}
+
+	cd.opt.LocalCache.Set(key, b)
+	return true
+}
+
+// marshalKey is like Marshal, but annotates errors with the key
+// and the value type. If compress is not nil, it overrides whether
+// the value is compressed.
+func (cd *Cache) marshalKey(key string, value interface{}, compress *bool) ([]byte, error) {
+	var b []byte
+	var err error
+	if compress != nil && cd.opt.Marshal == nil {
+		b, err = cd.marshalCompress(value, compress)
+	} else {
+		b, err = cd.marshal(value)
+	}
+	if err != nil {
+		err = fmt.Errorf("cache: can't marshal %T for key=%q: %w", value, key, err)
+		if cd.opt.OnMarshalError != nil {
+			cd.opt.OnMarshalError(key, value, err)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Marshal encodes the value the same way Set does. Strings, byte slices and
+// json.RawMessage are stored as is, and time.Time and net.IP use compact fixed-size
+// encodings. Values implementing msgpack.CustomEncoder or
+// msgpack.Marshaler are encoded with msgpack; otherwise
+// encoding.BinaryMarshaler is preferred over encoding.TextMarshaler,
+// which is preferred over msgpack.
 func (cd *Cache) Marshal(value interface{}) ([]byte, error) {
 	return cd.marshal(value)
 }
 
 func (cd *Cache) _marshal(value interface{}) ([]byte, error) {
+	return cd.marshalCompress(value, nil)
+}
+
+func (cd *Cache) marshalCompress(value interface{}, compress *bool) ([]byte, error) {
 	switch value := value.(type) {
 	case nil:
-		return nil, nil
+		return []byte{nilValue}, nil
 	case []byte:
-		return value, nil
+		// Copy the value, so the caller can reuse the slice after Set
+		// without changing the local cache entry.
+		b := make([]byte, len(value))
+		copy(b, value)
+		return escapeRaw(b), nil
+	case json.RawMessage:
+		b := make([]byte, len(value))
+		copy(b, value)
+		return escapeRaw(b), nil
 	case string:
-		return []byte(value), nil
+		return escapeRaw([]byte(value)), nil
+	case time.Time:
+		return marshalTime(value), nil
+	case net.IP:
+		return marshalIP(value), nil
+	case msgpack.CustomEncoder, msgpack.Marshaler:
+	case encoding.BinaryMarshaler:
+		b, err := value.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return cd.compress(header{encoding: binaryEncoding}, b, compress), nil
+	case encoding.TextMarshaler:
+		b, err := value.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return cd.compress(header{encoding: textEncoding}, b, compress), nil
 	}
 
 	buf := cd.bufpool.Get()
 	defer cd.bufpool.Put(buf)
 
+	h := header{encoding: msgpackEncoding}
+	if name, ok := registeredName(value); ok {
+		h.encoding = typedEncoding
+		buf.Write(appendTypeName(nil, name))
+	}
+
 	enc := msgpack.GetEncoder()
 	enc.Reset(buf)
 	enc.UseCompactInts(true)
+	if cd.opt.SortMapKeys {
+		enc.SetSortMapKeys(true)
+	}
 
 	err := enc.Encode(value)
 
@@ -353,23 +2288,7 @@ func (cd *Cache) _marshal(value interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	return compress(buf.Bytes()), nil
-}
-
-func compress(data []byte) []byte {
-	if len(data) < compressionThreshold {
-		n := len(data) + 1
-		b := make([]byte, n, n+timeLen)
-		copy(b, data)
-		b[len(b)-1] = noCompression
-		return b
-	}
-
-	n := s2.MaxEncodedLen(len(data)) + 1
-	b := make([]byte, n, n+timeLen)
-	b = s2.Encode(b, data)
-	b = append(b, s2Compression)
-	return b
+	return cd.compress(h, buf.Bytes(), compress), nil
 }
 
 func (cd *Cache) Unmarshal(b []byte, value interface{}) error {
@@ -377,7 +2296,7 @@ func (cd *Cache) Unmarshal(b []byte, value interface{}) error {
 }
 
 func (cd *Cache) _unmarshal(b []byte, value interface{}) error {
-	if len(b) == 0 {
+	if len(b) == 0 || isNilValue(b) {
 		return nil
 	}
 
@@ -385,38 +2304,65 @@ func (cd *Cache) _unmarshal(b []byte, value interface{}) error {
 	case nil:
 		return nil
 	case *[]byte:
+		b = unescapeRaw(b)
+		clone := make([]byte, len(b))
+		copy(clone, b)
+		*value = clone
+		return nil
+	case *json.RawMessage:
+		b = unescapeRaw(b)
 		clone := make([]byte, len(b))
 		copy(clone, b)
 		*value = clone
 		return nil
 	case *string:
-		*value = string(b)
+		*value = string(unescapeRaw(b))
 		return nil
 	}
 
-	switch c := b[len(b)-1]; c {
-	case noCompression:
-		b = b[:len(b)-1]
-	case s2Compression:
-		b = b[:len(b)-1]
-
-		n, err := s2.DecodedLen(b)
-		if err != nil {
-			return err
+	h, payload, ok := parseHeader(b)
+	if !ok {
+		if cd.opt.DecodeJSON && isJSON(b) {
+			return json.Unmarshal(b, value)
 		}
+		h.encoding = msgpackEncoding
+		h.compression, payload = splitLegacy(b)
+	}
 
-		buf := bufpool.Get(n)
-		defer bufpool.Put(buf)
+	b, buf, err := cd.decompress(h.compression, payload)
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		defer cd.bufpool.Put(buf)
+	}
 
-		b, err = s2.Decode(buf.Bytes(), b)
-		if err != nil {
-			return err
-		}
+	switch h.encoding {
+	case timeEncoding:
+		return unmarshalTime(b, value)
+	case ipEncoding:
+		return unmarshalIP(b, value)
+	case binaryEncoding:
+		return unmarshalBinary(b, value)
+	case textEncoding:
+		return unmarshalText(b, value)
+	case typedEncoding:
+		return unmarshalTyped(b, value)
 	default:
-		return fmt.Errorf("unknown compression method: %x", c)
+		return unmarshalMsgpack(b, value)
+	}
+}
+
+func (cd *Cache) onMiss(key string) {
+	if cd.opt.OnMiss != nil {
+		cd.opt.OnMiss(key)
 	}
+}
 
-	return msgpack.Unmarshal(b, value)
+func (cd *Cache) onError(err error) {
+	if cd.opt.OnError != nil {
+		cd.opt.OnError(err)
+	}
 }
 
 //------------------------------------------------------------------------------
@@ -424,6 +2370,141 @@ func (cd *Cache) _unmarshal(b []byte, value interface{}) error {
 type Stats struct {
 	Hits   uint64
 	Misses uint64
+	// SlowOps is the number of operations slower than
+	// Options.SlowThreshold.
+	SlowOps uint64
+	// Computed is the number of Once calls that missed the local cache
+	// and looked up the value or called Do themselves.
+	Computed uint64
+	// Shared is the number of Once calls that waited for the result
+	// of a concurrent call for the same key or group key.
+	Shared uint64
+	// Errors is the number of Redis reads that failed with an error other
+	// than a missing key. They are not counted as misses.
+	Errors uint64
+}
+
+const statsVersion = 1
+
+func (s *Stats) counters() []*uint64 {
+	return []*uint64{&s.Hits, &s.Misses, &s.SlowOps, &s.Computed, &s.Shared, &s.Errors}
+}
+
+// Add adds the counters of other to s, e.g. to aggregate the stats
+// of several instances.
+func (s *Stats) Add(other *Stats) {
+	dst := s.counters()
+	for i, n := range other.counters() {
+		*dst[i] += *n
+	}
+}
+
+// MarshalBinary encodes the stats as a version byte followed by the
+// counters as uvarints.
+func (s *Stats) MarshalBinary() ([]byte, error) {
+	counters := s.counters()
+	b := make([]byte, 1+len(counters)*binary.MaxVarintLen64)
+	b[0] = statsVersion
+	n := 1
+	for _, counter := range counters {
+		n += binary.PutUvarint(b[n:], *counter)
+	}
+	return b[:n], nil
+}
+
+// UnmarshalBinary decodes stats encoded by MarshalBinary. Counters that are
+// missing, e.g. when the stats come from an older version, are set to zero,
+// and unknown counters are ignored.
+func (s *Stats) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 || b[0] != statsVersion {
+		return errors.New("cache: invalid stats encoding")
+	}
+	b = b[1:]
+
+	*s = Stats{}
+	for _, n := range s.counters() {
+		if len(b) == 0 {
+			break
+		}
+		v, size := binary.Uvarint(b)
+		if size <= 0 {
+			return errors.New("cache: invalid stats encoding")
+		}
+		*n = v
+		b = b[size:]
+	}
+	return nil
+}
+
+// trackSlow reports the operation if it took longer than
+// Options.SlowThreshold.
+func (cd *Cache) trackSlow(op, key string, start time.Time) {
+	dur := time.Since(start)
+	if dur < cd.opt.SlowThreshold {
+		return
+	}
+
+	if cd.opt.StatsEnabled {
+		atomic.AddUint64(&cd.slowOps, 1)
+	}
+	if cd.opt.OnSlow != nil {
+		cd.opt.OnSlow(op, key, dur)
+	}
+}
+
+// countReadError counts a failed Redis read as a miss when the key is
+// missing and as an error otherwise.
+func (cd *Cache) countReadError(ctx context.Context, err error) {
+	if !cd.statsEnabled(ctx) {
+		return
+	}
+	if err == redis.Nil {
+		atomic.AddUint64(&cd.misses, 1)
+	} else {
+		atomic.AddUint64(&cd.errors, 1)
+	}
+}
+
+// observeLatency reports the time since start to Options.ObserveLatency.
+func (cd *Cache) observeLatency(op, source string, start time.Time) {
+	if cd.opt.ObserveLatency != nil {
+		cd.opt.ObserveLatency(op, source, time.Since(start))
+	}
+}
+
+type skipStatsKey struct{}
+
+// WithoutStats returns a context that excludes the operations that use it
+// from the stats, e.g. for a background sweep that would skew the hit ratio.
+func WithoutStats(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipStatsKey{}, true)
+}
+
+type bypassKey struct{}
+
+// WithBypass returns a context that makes Get, Once, GetBatch and OnceBatch
+// ignore the cached values, e.g. to debug a single request on the cold path.
+// Get and GetBatch report misses, and Once and OnceBatch load and cache the
+// fresh values.
+func WithBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+func bypassed(ctx context.Context) bool {
+	return ctx.Value(bypassKey{}) != nil
+}
+
+func (cd *Cache) statsEnabled(ctx context.Context) bool {
+	return cd.opt.StatsEnabled && ctx.Value(skipStatsKey{}) == nil
+}
+
+// Flush waits until the pending writes reach Redis, e.g. before the process
+// exits. All writes are currently synchronous and done by the time the
+// methods return, so it returns nil right away. It is the hook for async
+// writes, so code that calls it on shutdown keeps working when they are
+// added.
+func (cd *Cache) Flush(ctx context.Context) error {
+	return nil
 }
 
 // Stats returns cache statistics.
@@ -432,7 +2513,42 @@ func (cd *Cache) Stats() *Stats {
 		return nil
 	}
 	return &Stats{
-		Hits:   atomic.LoadUint64(&cd.hits),
-		Misses: atomic.LoadUint64(&cd.misses),
+		Hits:     atomic.LoadUint64(&cd.hits),
+		Misses:   atomic.LoadUint64(&cd.misses),
+		SlowOps:  atomic.LoadUint64(&cd.slowOps),
+		Computed: atomic.LoadUint64(&cd.computed),
+		Shared:   atomic.LoadUint64(&cd.shared),
+		Errors:   atomic.LoadUint64(&cd.errors),
+	}
+}
+
+// RedisPoolStats returns the connection pool stats of the Redis client,
+// accumulated over the shards. It returns nil if none of the clients
+// reports pool stats, e.g. when Redis is a custom implementation.
+func (cd *Cache) RedisPoolStats() *redis.PoolStats {
+	var acc *redis.PoolStats
+	for _, shard := range cd.shards {
+		pooler, ok := shard.(interface {
+			PoolStats() *redis.PoolStats
+		})
+		if !ok {
+			continue
+		}
+
+		s := pooler.PoolStats()
+		if s == nil {
+			continue
+		}
+		if acc == nil {
+			acc = new(redis.PoolStats)
+		}
+		acc.Hits += s.Hits
+		acc.Misses += s.Misses
+		acc.Timeouts += s.Timeouts
+
+		acc.TotalConns += s.TotalConns
+		acc.IdleConns += s.IdleConns
+		acc.StaleConns += s.StaleConns
 	}
+	return acc
 }
@@ -1,17 +1,29 @@
 package cache_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/klauspost/compress/s2"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/vmihailenco/bufpool"
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/go-redis/cache/v8"
 )
@@ -45,6 +57,7 @@ var _ = Describe("Cache", func() {
 
 	var rdb *redis.Ring
 	var mycache *cache.Cache
+	var hasLocalCache bool
 
 	testCache := func() {
 		It("Gets and Sets nil", func() {
@@ -60,6 +73,74 @@ var _ = Describe("Cache", func() {
 			Expect(mycache.Exists(ctx, key)).To(BeTrue())
 		})
 
+		It("Gets nil without touching the value", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			dst := "unchanged"
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal("unchanged"))
+
+			wanted := &Object{Num: 1}
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(&Object{Num: 1}))
+
+			err = mycache.Get(ctx, "missing-key", &dst)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			if rdb != nil {
+				b, err := rdb.Get(ctx, key).Bytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b).To(HaveLen(1))
+			}
+		})
+
+		It("tells raw 0xc1 values apart from nil", func() {
+			for _, value := range [][]byte{{0xc1}, {0xc1, 0xc1}} {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: value,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var b []byte
+				err = mycache.Get(ctx, key, &b)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b).To(Equal(value))
+
+				err = mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: string(value),
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				s := "unchanged"
+				err = mycache.Get(ctx, key, &s)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s).To(Equal(string(value)))
+			}
+		})
+
+		It("flushes without pending writes", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Flush(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mycache.Exists(ctx, key)).To(BeTrue())
+		})
+
 		It("Deletes key", func() {
 			err := mycache.Set(&cache.Item{
 				Ctx: ctx,
@@ -79,6 +160,139 @@ var _ = Describe("Cache", func() {
 			Expect(mycache.Exists(ctx, key)).To(BeFalse())
 		})
 
+		It("checks many keys with ExistsMany", func() {
+			for _, key := range []string{"key1", "key2"} {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			m, err := mycache.ExistsMany(ctx, []string{"key1", "key2", "key3"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[string]bool{
+				"key1": true,
+				"key2": true,
+				"key3": false,
+			}))
+		})
+
+		It("returns the size of the stored value", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := mycache.Marshal(obj)
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := mycache.Size(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(b)))
+
+			if rdb != nil {
+				mycache.DeleteFromLocalCache(key)
+				n, err = mycache.Size(ctx, key)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(Equal(len(b)))
+			}
+
+			_, err = mycache.Size(ctx, "missing")
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+		})
+
+		It("lists missing keys", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key2",
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			missing, err := mycache.MissingKeys(ctx, []string{"key3", "key2", "key1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(missing).To(Equal([]string{"key3", "key1"}))
+		})
+
+		It("gets many keys with GetBatch", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key1",
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key2",
+				Value: int64(0),
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			obj1 := new(Object)
+			var got bool
+			errs := mycache.GetBatch(ctx, []string{"key1", "key2", "key3"}, []interface{}{obj1, &got, nil})
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0]).NotTo(HaveOccurred())
+			Expect(obj1).To(Equal(obj))
+			Expect(errs[1]).To(Equal(cache.ErrCacheMiss))
+			Expect(errs[2]).To(Equal(cache.ErrCacheMiss))
+			Expect(mycache.Exists(ctx, "key2")).To(BeTrue())
+		})
+
+		It("returns Redis pool stats", func() {
+			stats := mycache.RedisPoolStats()
+			if rdb == nil && hasLocalCache {
+				// The cache is used without Redis.
+				Expect(stats).To(BeNil())
+				return
+			}
+
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+
+			stats = mycache.RedisPoolStats()
+			Expect(stats).NotTo(BeNil())
+			Expect(stats.TotalConns).To(BeNumerically(">", 0))
+		})
+
+		It("returns raw local bytes", func() {
+			_, ok := mycache.RawLocal(key)
+			Expect(ok).To(BeFalse())
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			b, ok := mycache.RawLocal(key)
+			Expect(ok).To(Equal(hasLocalCache))
+			if hasLocalCache {
+				got := new(Object)
+				Expect(mycache.Unmarshal(b, got)).NotTo(HaveOccurred())
+				Expect(got).To(Equal(obj))
+			}
+		})
+
+		It("Touches local cache entry", func() {
+			Expect(mycache.TouchLocal(key)).To(BeFalse())
+
+			err := mycache.Set(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				TTL: time.Hour,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mycache.TouchLocal(key)).To(Equal(hasLocalCache))
+			Expect(mycache.Exists(ctx, key)).To(BeTrue())
+		})
+
 		It("Gets and Sets data", func() {
 			err := mycache.Set(&cache.Item{
 				Ctx:   ctx,
@@ -96,24 +310,71 @@ var _ = Describe("Cache", func() {
 			Expect(mycache.Exists(ctx, key)).To(BeTrue())
 		})
 
-		It("Sets string as is", func() {
-			value := "str_value"
+		It("replaces sub-second TTL with the default", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+				TTL:   250 * time.Millisecond,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			if rdb != nil {
+				ttl, err := rdb.PTTL(ctx, key).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ttl).To(BeNumerically("~", time.Hour, time.Second))
+			}
+		})
+
+		It("keeps existing TTL with KeepTTL", func() {
+			if rdb == nil {
+				return
+			}
 
 			err := mycache.Set(&cache.Item{
 				Ctx:   ctx,
 				Key:   key,
-				Value: value,
+				Value: "hello",
+				TTL:   time.Minute,
 			})
 			Expect(err).NotTo(HaveOccurred())
 
-			var dst string
-			err = mycache.Get(ctx, key, &dst)
+			err = mycache.Set(&cache.Item{
+				Ctx:     ctx,
+				Key:     key,
+				Value:   "world",
+				KeepTTL: true,
+			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(dst).To(Equal(value))
+
+			var got string
+			err = mycache.GetSkippingLocalCache(ctx, key, &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal("world"))
+
+			ttl, err := rdb.TTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(Equal(time.Minute))
 		})
 
-		It("Sets bytes as is", func() {
-			value := []byte("str_value")
+		It("Gets and Sets compressed data", func() {
+			obj.Str = strings.Repeat("my very large string", 10)
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+		})
+
+		It("Uses BinaryMarshaler", func() {
+			value := &BinaryObject{Num: 42}
 
 			err := mycache.Set(&cache.Item{
 				Ctx:   ctx,
@@ -122,280 +383,3539 @@ var _ = Describe("Cache", func() {
 			})
 			Expect(err).NotTo(HaveOccurred())
 
-			var dst []byte
-			err = mycache.Get(ctx, key, &dst)
+			if rdb != nil {
+				b, err := rdb.Get(ctx, key).Bytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b).To(HaveSuffix("num=42"))
+			}
+
+			wanted := new(BinaryObject)
+			err = mycache.Get(ctx, key, wanted)
 			Expect(err).NotTo(HaveOccurred())
-			Expect(dst).To(Equal(value))
+			Expect(wanted).To(Equal(value))
+
+			err = mycache.Get(ctx, key, new(Object))
+			Expect(err).To(MatchError(
+				"cache: *cache_test.Object does not implement encoding.BinaryUnmarshaler"))
 		})
 
-		It("can be used with Incr", func() {
+		It("Gets and Sets time and IP", func() {
+			tm := time.Date(2020, 12, 25, 10, 30, 0, 123456789, time.UTC)
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: tm,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var gotTime time.Time
+			err = mycache.Get(ctx, key, &gotTime)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gotTime).To(BeTemporally("==", tm))
+			Expect(gotTime.Location()).To(Equal(time.Local))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: time.Time{},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Get(ctx, key, &gotTime)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gotTime).To(Equal(time.Time{}))
+
+			ip := net.ParseIP("192.168.1.1")
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: ip,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var gotIP net.IP
+			err = mycache.Get(ctx, key, &gotIP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gotIP.Equal(ip)).To(BeTrue())
+			Expect(gotIP).To(HaveLen(net.IPv4len))
+		})
+
+		It("does not store compressed data that is larger", func() {
 			if rdb == nil {
 				return
 			}
 
-			value := "123"
+			data := make([]byte, 100)
+			_, err := rand.Read(data)
+			Expect(err).NotTo(HaveOccurred())
 
-			err := mycache.Set(&cache.Item{
+			err = mycache.Set(&cache.Item{
 				Ctx:   ctx,
 				Key:   key,
-				Value: value,
+				Value: &Object{Str: string(data)},
 			})
 			Expect(err).NotTo(HaveOccurred())
 
-			n, err := rdb.Incr(ctx, key).Result()
+			plain, err := msgpack.Marshal(&Object{Str: string(data)})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(124)))
+
+			b, err := rdb.Get(ctx, key).Bytes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(b)).To(BeNumerically("<=", len(plain)+4))
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted.Str).To(Equal(string(data)))
 		})
 
-		Describe("Once func", func() {
-			It("calls Func when cache fails", func() {
-				err := mycache.Set(&cache.Item{
-					Ctx:   ctx,
-					Key:   key,
-					Value: int64(0),
-				})
-				Expect(err).NotTo(HaveOccurred())
+		It("overrides compression with Item.Compress", func() {
+			if rdb == nil {
+				return
+			}
 
-				var got bool
-				err = mycache.Get(ctx, key, &got)
-				Expect(err).To(MatchError("msgpack: invalid code=0 decoding bool"))
+			large := &Object{Str: strings.Repeat("my very large string", 10)}
+			small := &Object{Str: strings.Repeat("a", 32)}
+			no, yes := false, true
 
-				err = mycache.Once(&cache.Item{
-					Ctx:   ctx,
-					Key:   key,
-					Value: &got,
-					Do: func(*cache.Item) (interface{}, error) {
-						return true, nil
-					},
-				})
+			err := mycache.Set(&cache.Item{
+				Ctx:      ctx,
+				Key:      "large",
+				Value:    large,
+				Compress: &no,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Set(&cache.Item{
+				Ctx:      ctx,
+				Key:      "small",
+				Value:    small,
+				Compress: &yes,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for key, obj := range map[string]*Object{"large": large, "small": small} {
+				plain, err := msgpack.Marshal(obj)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(got).To(BeTrue())
 
-				got = false
-				err = mycache.Get(ctx, key, &got)
+				b, err := rdb.Get(ctx, key).Bytes()
 				Expect(err).NotTo(HaveOccurred())
-				Expect(got).To(BeTrue())
+				if obj == large {
+					Expect(len(b)).To(Equal(len(plain) + 4))
+				} else {
+					Expect(len(b)).To(BeNumerically("<", len(plain)))
+				}
+
+				wanted := new(Object)
+				err = mycache.Get(ctx, key, wanted)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(wanted).To(Equal(obj))
+			}
+		})
+
+		It("Sets string as is", func() {
+			value := "str_value"
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: value,
 			})
+			Expect(err).NotTo(HaveOccurred())
 
-			It("does not cache when Func fails", func() {
+			var dst string
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal(value))
+		})
+
+		It("Sets bytes as is", func() {
+			value := []byte("str_value")
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: value,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var dst []byte
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal(value))
+		})
+
+		It("Sets json.RawMessage as is", func() {
+			value := json.RawMessage(`{"hello":"world"}`)
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: value,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var dst json.RawMessage
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal(value))
+
+			if rdb != nil {
+				b, err := rdb.Get(ctx, key).Bytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b).To(Equal([]byte(value)))
+			}
+		})
+
+		It("copies bytes on Set", func() {
+			value := []byte("hello")
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: value,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			value[0] = 'j'
+
+			var got []byte
+			err = mycache.Get(ctx, key, &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal([]byte("hello")))
+			got[0] = 'j'
+
+			err = mycache.Get(ctx, key, &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal([]byte("hello")))
+		})
+
+		It("Gets data set without a header", func() {
+			if rdb == nil {
+				return
+			}
+
+			b, err := msgpack.Marshal(obj)
+			Expect(err).NotTo(HaveOccurred())
+			b = append(b, 0x0)
+
+			err = rdb.Set(ctx, key, b, time.Hour).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+		})
+
+		It("Gets compressed data set without a header that starts like a header", func() {
+			// The s2 length uvarint of these sizes is 0xc1 and a valid encoding.
+			for n := 1; n <= 6; n++ {
+				size := 65 + 128*n
+
+				values := []interface{}{
+					strings.Repeat("a", size-3),
+					strings.Repeat("abc", size)[:size-3],
+					bytes.Repeat([]byte{0}, size-3),
+				}
+				for _, value := range values {
+					b, err := msgpack.Marshal(value)
+					Expect(err).NotTo(HaveOccurred())
+					for len(b) < size {
+						// Grow the value until it is encoded with the size.
+						switch v := value.(type) {
+						case string:
+							value = v + "a"
+						case []byte:
+							value = append(v, 0)
+						}
+						b, err = msgpack.Marshal(value)
+						Expect(err).NotTo(HaveOccurred())
+					}
+					Expect(b).To(HaveLen(size))
+
+					b = append(s2.Encode(nil, b), 0x1)
+					Expect(b[:2]).To(Equal([]byte{0xc1, byte(n)}))
+
+					var got interface{}
+					err = mycache.Unmarshal(b, &got)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal(value))
+				}
+			}
+		})
+
+		It("binds context", func() {
+			c := mycache.WithContext(ctx)
+
+			err := c.Set(&cache.Item{
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Exists(key)).To(BeTrue())
+
+			wanted := new(Object)
+			err = c.Get(key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+
+			err = c.Delete(key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Exists(key)).To(BeFalse())
+
+			if rdb != nil {
+				canceled, cancel := context.WithCancel(ctx)
+				cancel()
+
+				err = mycache.WithContext(canceled).Set(&cache.Item{
+					Key:   key,
+					Value: obj,
+				})
+				Expect(err).To(Equal(context.Canceled))
+			}
+		})
+
+		It("replaces value with GetSet", func() {
+			if rdb == nil {
+				return
+			}
+
+			var old Object
+			err := mycache.GetSet(ctx, key, obj, &old, time.Hour)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			next := &Object{Str: "next", Num: 43}
+			err = mycache.GetSet(ctx, key, next, &old, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(&old).To(Equal(obj))
+
+			ttl, err := rdb.TTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", time.Hour, time.Second))
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(next))
+		})
+
+		It("reports whether Set created the key", func() {
+			if rdb == nil && !hasLocalCache {
+				return
+			}
+
+			for _, wanted := range []bool{true, false} {
+				created, err := mycache.SetReturningCreated(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+					TTL:   time.Minute,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(created).To(Equal(wanted))
+			}
+
+			if rdb != nil {
+				ttl, err := rdb.PTTL(ctx, key).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+			}
+
+			got := new(Object)
+			err := mycache.Get(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+		})
+
+		It("reports whether Set created a key that is only cached locally", func() {
+			if !hasLocalCache {
+				return
+			}
+
+			for _, wanted := range []bool{true, false} {
+				created, err := mycache.SetReturningCreated(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+					TTL:   -1,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(created).To(Equal(wanted))
+			}
+		})
+
+		It("caches side items with SetReturningCreated", func() {
+			if rdb == nil && !hasLocalCache {
+				return
+			}
+
+			created, err := mycache.SetReturningCreated(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return &cache.SideValues{
+						Value: obj,
+						Items: []*cache.Item{{Key: "side1", Value: "value1"}},
+					}, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).To(BeTrue())
+
+			var got string
+			err = mycache.Get(ctx, "side1", &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal("value1"))
+		})
+
+		It("reads the raw Redis value with RedisBytes", func() {
+			if rdb == nil {
+				return
+			}
+
+			_, err := mycache.RedisBytes(ctx, key)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted, err := mycache.Marshal(obj)
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := mycache.RedisBytes(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal(wanted))
+		})
+
+		It("gets a value with its TTL", func() {
+			if rdb == nil {
+				return
+			}
+
+			_, err := mycache.GetWithTTL(ctx, key, new(Object))
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+				TTL:   time.Minute,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			got := new(Object)
+			ttl, err := mycache.GetWithTTL(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+			Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+		})
+
+		It("recomputes a cached value with Refresh", func() {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			refreshed := &Object{Str: "refreshed", Num: 43}
+			got := new(Object)
+			err = mycache.Refresh(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: got,
+				Do: func(*cache.Item) (interface{}, error) {
+					return refreshed, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(refreshed))
+
+			got = new(Object)
+			err = mycache.Get(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(refreshed))
+		})
+
+		It("caches with the TTL returned by DoTTL", func() {
+			if rdb == nil {
+				return
+			}
+
+			got := new(Object)
+			err := mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: got,
+				TTL:   time.Hour,
+				DoTTL: func(*cache.Item) (interface{}, time.Duration, error) {
+					return obj, 2 * time.Minute, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+
+			ttl, err := rdb.PTTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", 2*time.Minute, time.Second))
+		})
+
+		It("does not change the item passed to Once with DoTTL", func() {
+			item := &cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: new(Object),
+				TTL:   time.Hour,
+				DoTTL: func(*cache.Item) (interface{}, time.Duration, error) {
+					return obj, 2 * time.Minute, nil
+				},
+			}
+			err := mycache.Once(item)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.TTL).To(Equal(time.Hour))
+
+			// The item is reused for another key with Do.
+			item.Key = key + "2"
+			item.Do = func(*cache.Item) (interface{}, error) {
+				return obj, nil
+			}
+			err = mycache.Once(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			if rdb == nil {
+				return
+			}
+			ttl, err := rdb.PTTL(ctx, item.Key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", time.Hour, time.Second))
+		})
+
+		It("caps TTL to the context deadline", func() {
+			if rdb == nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, time.Minute)
+			defer cancel()
+
+			err := mycache.Once(&cache.Item{
+				Ctx:              ctx,
+				Key:              key,
+				Value:            new(Object),
+				TTL:              time.Hour,
+				CapTTLToDeadline: true,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := rdb.PTTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("<=", time.Minute))
+			Expect(ttl).To(BeNumerically(">", 59*time.Second))
+		})
+
+		It("takes a value once", func() {
+			if rdb == nil {
+				return
+			}
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			got := new(Object)
+			err = mycache.Take(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+
+			err = mycache.Take(ctx, key, got)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+		})
+
+		It("decrements with a floor", func() {
+			if rdb == nil {
+				return
+			}
+
+			n, err := mycache.DecrementFloor(ctx, key, 1, 0, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(0)))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "10",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err = mycache.DecrementFloor(ctx, key, 3, 0, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(7)))
+
+			n, err = mycache.DecrementFloor(ctx, key, 10, 0, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(0)))
+
+			var dst string
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal("0"))
+
+			ttl, err := rdb.TTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", time.Hour, time.Second))
+		})
+
+		It("can be used with Incr", func() {
+			if rdb == nil {
+				return
+			}
+
+			value := "123"
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: value,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := rdb.Incr(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(124)))
+		})
+
+		Describe("Once func", func() {
+			It("calls Func when cache fails", func() {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: int64(0),
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var got bool
+				err = mycache.Get(ctx, key, &got)
+				Expect(err).To(MatchError("msgpack: invalid code=0 decoding bool"))
+
+				err = mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: &got,
+					Do: func(*cache.Item) (interface{}, error) {
+						return true, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(BeTrue())
+
+				got = false
+				err = mycache.Get(ctx, key, &got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(BeTrue())
+			})
+
+			It("does not cache when Func fails", func() {
+				perform(100, func(int) {
+					var got bool
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: &got,
+						Do: func(*cache.Item) (interface{}, error) {
+							return nil, io.EOF
+						},
+					})
+					Expect(err).To(Equal(io.EOF))
+					Expect(got).To(BeFalse())
+				})
+
+				var got bool
+				err := mycache.Get(ctx, key, &got)
+				Expect(err).To(Equal(cache.ErrCacheMiss))
+
+				err = mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: &got,
+					Do: func(*cache.Item) (interface{}, error) {
+						return true, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(BeTrue())
+			})
+
+			It("works with Value", func() {
+				var callCount int64
+				perform(100, func(int) {
+					got := new(Object)
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: got,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return obj, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal(obj))
+				})
+				Expect(callCount).To(Equal(int64(1)))
+			})
+
+			It("works with ptr and non-ptr", func() {
+				var callCount int64
+				perform(100, func(int) {
+					got := new(Object)
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: got,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return *obj, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal(obj))
+				})
+				Expect(callCount).To(Equal(int64(1)))
+			})
+
+			It("works with bool", func() {
+				var callCount int64
+				perform(100, func(int) {
+					var got bool
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: &got,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return true, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(BeTrue())
+				})
+				Expect(callCount).To(Equal(int64(1)))
+			})
+
+			It("works without Value and nil result", func() {
+				var callCount int64
 				perform(100, func(int) {
-					var got bool
 					err := mycache.Once(&cache.Item{
-						Ctx:   ctx,
-						Key:   key,
-						Value: &got,
+						Ctx: ctx,
+						Key: key,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return nil, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Expect(callCount).To(Equal(int64(1)))
+			})
+
+			It("works without Value and error result", func() {
+				var callCount int64
+				perform(100, func(int) {
+					err := mycache.Once(&cache.Item{
+						Ctx: ctx,
+						Key: key,
+						Do: func(*cache.Item) (interface{}, error) {
+							time.Sleep(100 * time.Millisecond)
+							atomic.AddInt64(&callCount, 1)
+							return nil, errors.New("error stub")
+						},
+					})
+					Expect(err).To(MatchError("error stub"))
+				})
+				Expect(callCount).To(Equal(int64(1)))
+			})
+
+			It("does not cache error result", func() {
+				var callCount int64
+				do := func(sleep time.Duration) (int, error) {
+					var n int
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: &n,
+						Do: func(*cache.Item) (interface{}, error) {
+							time.Sleep(sleep)
+
+							n := atomic.AddInt64(&callCount, 1)
+							if n == 1 {
+								return nil, errors.New("error stub")
+							}
+							return 42, nil
+						},
+					})
+					if err != nil {
+						return 0, err
+					}
+					return n, nil
+				}
+
+				perform(100, func(int) {
+					n, err := do(100 * time.Millisecond)
+					Expect(err).To(MatchError("error stub"))
+					Expect(n).To(Equal(0))
+				})
+
+				perform(100, func(int) {
+					n, err := do(0)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(n).To(Equal(42))
+				})
+
+				Expect(callCount).To(Equal(int64(2)))
+			})
+
+			It("fails when Do takes longer than TTL", func() {
+				var value string
+				err := mycache.Once(&cache.Item{
+					Ctx:          ctx,
+					Key:          key,
+					Value:        &value,
+					TTL:          time.Second,
+					BoundDoByTTL: true,
+					Do: func(item *cache.Item) (interface{}, error) {
+						_, ok := item.Context().Deadline()
+						Expect(ok).To(BeTrue())
+
+						<-item.Context().Done()
+						return "hello", nil
+					},
+				})
+				Expect(err).To(MatchError(`cache: Do for key="mykey" took longer than TTL=1s`))
+
+				err = mycache.Get(ctx, key, &value)
+				Expect(err).To(Equal(cache.ErrCacheMiss))
+			})
+
+			It("bypasses cached values with WithBypass", func() {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: "cached",
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				bypassCtx := cache.WithBypass(ctx)
+
+				var value string
+				err = mycache.Get(bypassCtx, key, &value)
+				Expect(err).To(Equal(cache.ErrCacheMiss))
+
+				err = mycache.Once(&cache.Item{
+					Ctx:   bypassCtx,
+					Key:   key,
+					Value: &value,
+					Do: func(*cache.Item) (interface{}, error) {
+						return "fresh", nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("fresh"))
+
+				err = mycache.Get(ctx, key, &value)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("fresh"))
+			})
+
+			It("bypasses cached values in GetBatch and OnceBatch with WithBypass", func() {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: "cached",
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				bypassCtx := cache.WithBypass(ctx)
+
+				var value string
+				errs := mycache.GetBatch(bypassCtx, []string{key}, []interface{}{&value})
+				Expect(errs).To(Equal([]error{cache.ErrCacheMiss}))
+
+				var missing []string
+				load := func(keys []string) (map[string]interface{}, error) {
+					missing = keys
+					return map[string]interface{}{key: "fresh"}, nil
+				}
+				dst := map[string]interface{}{key: &value}
+				err = mycache.OnceBatch(bypassCtx, []string{key}, load, time.Hour, dst)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(missing).To(Equal([]string{key}))
+				Expect(value).To(Equal("fresh"))
+
+				err = mycache.Get(ctx, key, &value)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("fresh"))
+			})
+
+			It("caches SideValues returned by Do", func() {
+				var value string
+				err := mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: &value,
+					Do: func(*cache.Item) (interface{}, error) {
+						return &cache.SideValues{
+							Value: "main",
+							Items: []*cache.Item{
+								{Key: "side1", Value: "one", TTL: time.Minute},
+								{Key: "side2", Value: obj},
+							},
+						}, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("main"))
+
+				err = mycache.Get(ctx, "side1", &value)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("one"))
+
+				got := new(Object)
+				err = mycache.Get(ctx, "side2", got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal(obj))
+
+				if rdb != nil {
+					ttl, err := rdb.PTTL(ctx, "side1").Result()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+				}
+			})
+
+			It("recomputes values stored with a different Version", func() {
+				var callCount int64
+				do := func(version uint16) *Object {
+					got := new(Object)
+					err := mycache.Once(&cache.Item{
+						Ctx:     ctx,
+						Key:     key,
+						Value:   got,
+						Version: version,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return &Object{Str: "v", Num: int(version)}, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return got
+				}
+
+				Expect(do(1).Num).To(Equal(1))
+				Expect(do(1).Num).To(Equal(1))
+				Expect(callCount).To(Equal(int64(1)))
+
+				Expect(do(2).Num).To(Equal(2))
+				Expect(callCount).To(Equal(int64(2)))
+
+				got := new(Object)
+				err := mycache.Get(ctx, key, got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got.Num).To(Equal(2))
+			})
+
+			It("returns value without caching on ErrSkipCache", func() {
+				var callCount int64
+				do := func() string {
+					var value string
+					err := mycache.Once(&cache.Item{
+						Ctx:   ctx,
+						Key:   key,
+						Value: &value,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							return "degraded", cache.ErrSkipCache
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return value
+				}
+
+				Expect(do()).To(Equal("degraded"))
+				Expect(do()).To(Equal("degraded"))
+				Expect(callCount).To(Equal(int64(2)))
+
+				err := mycache.Get(ctx, key, nil)
+				Expect(err).To(Equal(cache.ErrCacheMiss))
+			})
+
+			It("shares Do between keys with the same GroupKey", func() {
+				var callCount int64
+				perform(2, func(i int) {
+					var got string
+					err := mycache.Once(&cache.Item{
+						Ctx:      ctx,
+						Key:      fmt.Sprintf("key%d", i),
+						GroupKey: "group",
+						Value:    &got,
+						Do: func(*cache.Item) (interface{}, error) {
+							atomic.AddInt64(&callCount, 1)
+							time.Sleep(100 * time.Millisecond)
+							return "hello", nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal("hello"))
+				})
+				Expect(callCount).To(Equal(int64(1)))
+
+				for i := 0; i < 2; i++ {
+					var got string
+					err := mycache.Get(ctx, fmt.Sprintf("key%d", i), &got)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal("hello"))
+				}
+			})
+
+			It("caches value returned by PostCompute", func() {
+				var got []int
+				err := mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: &got,
+					Do: func(*cache.Item) (interface{}, error) {
+						return []int{3, 1, 2}, nil
+					},
+					PostCompute: func(v interface{}) (interface{}, error) {
+						ints := v.([]int)
+						sort.Ints(ints)
+						return ints, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal([]int{1, 2, 3}))
+
+				got = nil
+				err = mycache.Get(ctx, key, &got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal([]int{1, 2, 3}))
+			})
+
+			It("does not cache values larger than MaxSize", func() {
+				var value string
+				err := mycache.Once(&cache.Item{
+					Ctx:     ctx,
+					Key:     key,
+					Value:   &value,
+					MaxSize: 10,
+					Do: func(*cache.Item) (interface{}, error) {
+						return strings.Repeat("x", 11), nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(HaveLen(11))
+
+				err = mycache.Get(ctx, key, &value)
+				Expect(err).To(Equal(cache.ErrCacheMiss))
+
+				err = mycache.Set(&cache.Item{
+					Ctx:     ctx,
+					Key:     key,
+					Value:   strings.Repeat("x", 10),
+					MaxSize: 10,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = mycache.Get(ctx, key, &value)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(HaveLen(10))
+			})
+
+			It("skips Set when TTL = -1", func() {
+				key := "skip-set"
+
+				var value string
+				err := mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: &value,
+					Do: func(item *cache.Item) (interface{}, error) {
+						item.TTL = -1
+						return "hello", nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("hello"))
+
+				if rdb != nil {
+					exists, err := rdb.Exists(ctx, key).Result()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(Equal(int64(0)))
+				}
+			})
+		})
+
+		Describe("OnceBatch func", func() {
+			It("loads only missing keys", func() {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   "key1",
+					Value: obj,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var calls int64
+				load := func(missing []string) (map[string]interface{}, error) {
+					atomic.AddInt64(&calls, 1)
+					m := make(map[string]interface{}, len(missing))
+					for _, key := range missing {
+						m[key] = &Object{Str: key}
+					}
+					return m, nil
+				}
+
+				obj1, obj2, obj3 := new(Object), new(Object), new(Object)
+				err = mycache.OnceBatch(ctx, []string{"key1", "key2", "key3"}, func(missing []string) (map[string]interface{}, error) {
+					Expect(missing).To(Equal([]string{"key2", "key3"}))
+					return load(missing)
+				}, time.Hour, map[string]interface{}{
+					"key1": obj1,
+					"key2": obj2,
+					"key3": obj3,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj1).To(Equal(obj))
+				Expect(obj2).To(Equal(&Object{Str: "key2"}))
+				Expect(obj3).To(Equal(&Object{Str: "key3"}))
+				Expect(calls).To(Equal(int64(1)))
+
+				obj3 = new(Object)
+				err = mycache.OnceBatch(ctx, []string{"key1", "key2", "key3"}, load, time.Hour, map[string]interface{}{
+					"key3": obj3,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj3).To(Equal(&Object{Str: "key3"}))
+				Expect(calls).To(Equal(int64(1)))
+			})
+
+			It("does not cache when load fails", func() {
+				loadErr := errors.New("load failed")
+				err := mycache.OnceBatch(ctx, []string{key}, func([]string) (map[string]interface{}, error) {
+					return nil, loadErr
+				}, time.Hour, nil)
+				Expect(err).To(Equal(loadErr))
+
+				Expect(mycache.Exists(ctx, key)).To(BeFalse())
+			})
+		})
+	}
+
+	BeforeEach(func() {
+		obj = &Object{
+			Str: "mystring",
+			Num: 42,
+		}
+	})
+
+	Context("without LocalCache", func() {
+		BeforeEach(func() {
+			rdb = newRing()
+			mycache = newCache(rdb)
+			hasLocalCache = false
+		})
+
+		testCache()
+	})
+
+	Context("with LocalCache", func() {
+		BeforeEach(func() {
+			rdb = newRing()
+			mycache = newCacheWithLocal(rdb)
+			hasLocalCache = true
+		})
+
+		testCache()
+
+		It("rejects nil with RejectNilValue", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:          rdb,
+				LocalCache:     cache.NewTinyLFU(1000, time.Minute),
+				RejectNilValue: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+			})
+			Expect(errors.Is(err, cache.ErrNilValue)).To(BeTrue())
+
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return nil, nil
+				},
+			})
+			Expect(errors.Is(err, cache.ErrNilValue)).To(BeTrue())
+
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+		})
+
+		It("checks SideValues items like the value", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:              rdb,
+				LocalCache:         cache.NewTinyLFU(1000, time.Minute),
+				RequireExplicitTTL: true,
+				RejectNilValue:     true,
+			})
+
+			once := func(side ...*cache.Item) error {
+				return mycache.Once(&cache.Item{
+					Ctx: ctx,
+					Key: key,
+					TTL: time.Minute,
+					Do: func(*cache.Item) (interface{}, error) {
+						return &cache.SideValues{Value: "main", Items: side}, nil
+					},
+				})
+			}
+
+			err := once(&cache.Item{Key: "side", Value: "one"})
+			Expect(errors.Is(err, cache.ErrMissingTTL)).To(BeTrue())
+			Expect(err).To(MatchError(`cache: item has no TTL for key="side"`))
+
+			err = once(&cache.Item{Key: "side", TTL: time.Minute})
+			Expect(errors.Is(err, cache.ErrNilValue)).To(BeTrue())
+
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+			Expect(mycache.Exists(ctx, "side")).To(BeFalse())
+
+			err = once(
+				&cache.Item{Key: "side", Value: "one", TTL: time.Minute},
+				&cache.Item{
+					Key:     "large",
+					Value:   strings.Repeat("x", 100),
+					TTL:     time.Minute,
+					MaxSize: 10,
+				},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mycache.Exists(ctx, key)).To(BeTrue())
+			Expect(mycache.Exists(ctx, "side")).To(BeTrue())
+			Expect(mycache.Exists(ctx, "large")).To(BeFalse())
+		})
+
+		It("peeks without updating stats", func() {
+			var misses int64
+			mycache = cache.New(&cache.Options{
+				Redis:        rdb,
+				LocalCache:   cache.NewTinyLFU(1000, time.Minute),
+				StatsEnabled: true,
+				OnMiss: func(string) {
+					atomic.AddInt64(&misses, 1)
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			got := new(Object)
+			err = mycache.Peek(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+
+			err = mycache.Peek(ctx, "missing", got)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			Expect(mycache.Stats()).To(Equal(&cache.Stats{}))
+			Expect(misses).To(Equal(int64(0)))
+		})
+
+		It("warms local cache by pattern", func() {
+			for _, key := range []string{"config:a", "config:b", "other"} {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: key,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+			err := mycache.WarmLocalByPattern(ctx, "config:*")
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, key := range []string{"config:a", "config:b"} {
+				b, ok := mycache.RawLocal(key)
+				Expect(ok).To(BeTrue())
+				Expect(string(b)).To(Equal(key))
+			}
+			_, ok := mycache.RawLocal("other")
+			Expect(ok).To(BeFalse())
+
+			mycache = cache.New(&cache.Options{
+				Redis:      cache.InstrumentRediser(rdb, cache.Hooks{}),
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+			err = mycache.WarmLocalByPattern(ctx, "config:*")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, ok = mycache.RawLocal("config:a")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("reads Redis first with RedisFirst", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ReadOrder:  cache.RedisFirst,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "local",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = rdb.Set(ctx, key, "redis", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			var value string
+			err = mycache.Get(ctx, key, &value)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("redis"))
+
+			b, ok := mycache.RawLocal(key)
+			Expect(ok).To(BeTrue())
+			Expect(string(b)).To(Equal("redis"))
+
+			err = rdb.Set(ctx, key, "batch", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			errs := mycache.GetBatch(ctx, []string{key}, []interface{}{&value})
+			Expect(errs).To(Equal([]error{nil}))
+			Expect(value).To(Equal("batch"))
+		})
+
+		It("handles GetBatch decoding errors with BatchDecodeErrorPolicy", func() {
+			for _, policy := range []cache.DecodeErrorPolicy{
+				cache.FailOnDecodeError, cache.DeleteOnDecodeError,
+			} {
+				mycache = cache.New(&cache.Options{
+					Redis:                  rdb,
+					LocalCache:             cache.NewTinyLFU(1000, time.Minute),
+					BatchDecodeErrorPolicy: policy,
+				})
+
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: int64(0),
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var got bool
+				errs := mycache.GetBatch(ctx, []string{key}, []interface{}{&got})
+				if policy == cache.FailOnDecodeError {
+					Expect(errs[0]).To(MatchError("msgpack: invalid code=0 decoding bool"))
+					Expect(mycache.Exists(ctx, key)).To(BeTrue())
+				} else {
+					Expect(errs[0]).To(Equal(cache.ErrCacheMiss))
+					Expect(mycache.Exists(ctx, key)).To(BeFalse())
+				}
+			}
+		})
+
+		It("instruments Redis commands", func() {
+			var mu sync.Mutex
+			var names []string
+			mycache = cache.New(&cache.Options{
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				Redis: cache.InstrumentRediser(rdb, cache.Hooks{
+					OnCommand: func(_ context.Context, name string, dur time.Duration, err error) {
+						mu.Lock()
+						names = append(names, name)
+						mu.Unlock()
+
+						Expect(dur).To(BeNumerically(">", 0))
+						if name == "get" {
+							Expect(err).To(Equal(redis.Nil))
+						} else {
+							Expect(err).NotTo(HaveOccurred())
+						}
+					},
+				}),
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Delete(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.GetSkippingLocalCache(ctx, key, nil)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			Expect(names).To(Equal([]string{"set", "del", "get"}))
+			Expect(mycache.RedisPoolStats()).NotTo(BeNil())
+		})
+
+		It("does not write to Redis when ReadOnly", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ReadOnly:   true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).To(Equal(cache.ErrReadOnly))
+
+			err = mycache.Delete(ctx, key)
+			Expect(err).To(Equal(cache.ErrReadOnly))
+
+			got := new(Object)
+			err = mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: got,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+
+			n, err := rdb.Exists(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(0)))
+		})
+
+		It("treats empty Redis values as misses with EmptyAsMiss", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:       rdb,
+				LocalCache:  cache.NewTinyLFU(1000, time.Minute),
+				EmptyAsMiss: true,
+			})
+
+			Expect(rdb.Set(ctx, key, "", time.Hour).Err()).NotTo(HaveOccurred())
+
+			var got string
+			err := mycache.Get(ctx, key, &got)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+
+			err = mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: &got,
+				Do: func(*cache.Item) (interface{}, error) {
+					return "hello", nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal("hello"))
+		})
+
+		It("reports latency with ObserveLatency", func() {
+			var mu sync.Mutex
+			var observed []string
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ObserveLatency: func(op, source string, dur time.Duration) {
+					mu.Lock()
+					observed = append(observed, op+" "+source)
+					mu.Unlock()
+				},
+			})
+
+			err := mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(observed).To(ContainElement("once do"))
+			Expect(observed).To(ContainElements("get redis", "set redis"))
+			Expect(observed).To(ContainElements("get local", "set local"))
+		})
+
+		It("reports slow operations", func() {
+			var ops []string
+			mycache = cache.New(&cache.Options{
+				Redis:         rdb,
+				LocalCache:    cache.NewTinyLFU(1000, time.Minute),
+				StatsEnabled:  true,
+				SlowThreshold: 50 * time.Millisecond,
+				OnSlow: func(op, key string, dur time.Duration) {
+					ops = append(ops, op+" "+key)
+					Expect(dur).To(BeNumerically(">=", 50*time.Millisecond))
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: "slow",
+				Do: func(*cache.Item) (interface{}, error) {
+					time.Sleep(50 * time.Millisecond)
+					return obj, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ops).To(Equal([]string{"once slow"}))
+			Expect(mycache.Stats().SlowOps).To(Equal(uint64(1)))
+		})
+
+		It("requires explicit TTL with RequireExplicitTTL", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:              rdb,
+				LocalCache:         cache.NewTinyLFU(1000, time.Minute),
+				RequireExplicitTTL: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(errors.Is(err, cache.ErrMissingTTL)).To(BeTrue())
+			Expect(err).To(MatchError(`cache: item has no TTL for key="mykey"`))
+
+			var callCount int
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					callCount++
+					return obj, nil
+				},
+			})
+			Expect(errors.Is(err, cache.ErrMissingTTL)).To(BeTrue())
+			Expect(callCount).To(Equal(0))
+
+			err = mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: new(Object),
+				DoTTL: func(*cache.Item) (interface{}, time.Duration, error) {
+					return obj, time.Minute, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Once(&cache.Item{
+				Ctx:      ctx,
+				Key:      key + "2",
+				Fallback: obj,
+				DoTTL: func(*cache.Item) (interface{}, time.Duration, error) {
+					return obj, 0, nil
+				},
+			})
+			Expect(errors.Is(err, cache.ErrMissingTTL)).To(BeTrue())
+
+			for _, ttl := range []time.Duration{time.Minute, -1} {
+				err = mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+					TTL:   ttl,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("rejects keys longer than MaxKeyLength", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:        rdb,
+				LocalCache:   cache.NewTinyLFU(1000, time.Minute),
+				MaxKeyLength: 10,
+			})
+
+			longKey := strings.Repeat("k", 11)
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   longKey,
+				Value: obj,
+			})
+			Expect(errors.Is(err, cache.ErrKeyTooLong)).To(BeTrue())
+			Expect(err).To(MatchError(`cache: key is too long: 11 bytes, key="kkkkkkkkkkk"`))
+
+			err = mycache.Get(ctx, longKey, nil)
+			Expect(errors.Is(err, cache.ErrKeyTooLong)).To(BeTrue())
+
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: longKey,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(errors.Is(err, cache.ErrKeyTooLong)).To(BeTrue())
+
+			err = mycache.Delete(ctx, longKey)
+			Expect(errors.Is(err, cache.ErrKeyTooLong)).To(BeTrue())
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects keys with ValidateKey", func() {
+			errNoTenant := errors.New("key without tenant prefix")
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ValidateKey: func(key string) error {
+					if !strings.HasPrefix(key, "tenant1:") {
+						return errNoTenant
+					}
+					return nil
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Get(ctx, key, nil)
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Delete(ctx, key)
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.GetSet(ctx, key, obj, nil, time.Minute)
+			Expect(err).To(Equal(errNoTenant))
+
+			_, err = mycache.DecrementFloor(ctx, key, 1, 0, time.Minute)
+			Expect(err).To(Equal(errNoTenant))
+
+			_, err = mycache.ExistsMany(ctx, []string{key})
+			Expect(err).To(Equal(errNoTenant))
+
+			_, err = mycache.MissingKeys(ctx, []string{key})
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Peek(ctx, key, nil)
+			Expect(err).To(Equal(errNoTenant))
+
+			_, err = mycache.Size(ctx, key)
+			Expect(err).To(Equal(errNoTenant))
+
+			_, err = mycache.Age(ctx, key)
+			Expect(err).To(Equal(errNoTenant))
+
+			_, ok := mycache.RawLocal(key)
+			Expect(ok).To(BeFalse())
+			Expect(mycache.TouchLocal(key)).To(BeFalse())
+
+			err = mycache.PrefetchLocal(ctx, []string{key})
+			Expect(err).To(Equal(errNoTenant))
+
+			errs := mycache.GetBatch(ctx, []string{key}, []interface{}{nil})
+			Expect(errs).To(Equal([]error{errNoTenant}))
+
+			err = mycache.OnceBatch(ctx, []string{key}, func([]string) (map[string]interface{}, error) {
+				panic("not reached")
+			}, time.Minute, nil)
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Once(&cache.Item{
+				Ctx: ctx,
+				Key: "tenant1:" + key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return &cache.SideValues{
+						Value: obj,
+						Items: []*cache.Item{{Key: "side1", Value: "value1"}},
+					}, nil
+				},
+			})
+			Expect(err).To(Equal(errNoTenant))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "tenant1:" + key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("waits for Once in Get with UnifiedSingleFlight", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:               rdb,
+				LocalCache:          cache.NewTinyLFU(1000, time.Minute),
+				UnifiedSingleFlight: true,
+			})
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			onceErr := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				onceErr <- mycache.Once(&cache.Item{
+					Ctx: ctx,
+					Key: key,
+					Do: func(*cache.Item) (interface{}, error) {
+						close(started)
+						<-release
+						return obj, nil
+					},
+				})
+			}()
+			<-started
+
+			getErr := make(chan error, 1)
+			got := new(Object)
+			go func() {
+				getErr <- mycache.Get(ctx, key, got)
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+
+			Expect(<-onceErr).NotTo(HaveOccurred())
+			Expect(<-getErr).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+		})
+
+		It("decodes JSON values with DecodeJSON", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				DecodeJSON: true,
+			})
+
+			err := rdb.Set(ctx, key, `{"Str":"mystring","Num":42}`, 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			got := new(Object)
+			err = mycache.Get(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			got = new(Object)
+			err = mycache.Get(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+		})
+
+		It("transforms values on read with ReadTransform", func() {
+			var transforms int
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ReadTransform: func(key string, b []byte) ([]byte, error) {
+					if string(b) != "old" {
+						return nil, nil
+					}
+					transforms++
+					return []byte("new"), nil
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "old",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 2; i++ {
+				var got string
+				err = mycache.Get(ctx, key, &got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal("new"))
+			}
+			Expect(transforms).To(Equal(1))
+
+			b, err := rdb.Get(ctx, key).Bytes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("new"))
+
+			for _, key := range []string{"key1", "key2"} {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: "old",
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			got := make([]string, 2)
+			errs := mycache.GetBatch(ctx, []string{"key1", "key2"}, []interface{}{&got[0], &got[1]})
+			Expect(errs).To(Equal([]error{nil, nil}))
+			Expect(got).To(Equal([]string{"new", "new"}))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "old",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var value string
+			_, err = mycache.GetWithTTL(ctx, key, &value)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("new"))
+		})
+
+		It("does not recreate expired keys when writing back transformed values", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				ReadTransform: func(key string, b []byte) ([]byte, error) {
+					if string(b) != "old" {
+						return nil, nil
+					}
+					return []byte("new"), nil
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "old",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// The key expires in Redis while it is still cached locally.
+			err = rdb.Del(ctx, key).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			var got string
+			err = mycache.Get(ctx, key, &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal("new"))
+
+			n, err := rdb.Exists(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeZero())
+		})
+
+		It("reports the keys with the most Once calls", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				HotKeys:    2,
+			})
+
+			for key, calls := range map[string]int{"key1": 3, "key2": 2, "key3": 1} {
+				for i := 0; i < calls; i++ {
+					err := mycache.Once(&cache.Item{
+						Ctx: ctx,
+						Key: key,
+						Do: func(*cache.Item) (interface{}, error) {
+							return obj, nil
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}
+
+			Expect(mycache.TopKeys(10)).To(Equal([]cache.KeyStat{
+				{Key: "key1", Count: 3},
+				{Key: "key2", Count: 2},
+			}))
+			Expect(mycache.TopKeys(1)).To(Equal([]cache.KeyStat{
+				{Key: "key1", Count: 3},
+			}))
+		})
+
+		It("counts shared Once calls", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:        rdb,
+				LocalCache:   cache.NewTinyLFU(1000, time.Minute),
+				StatsEnabled: true,
+			})
+
+			perform(10, func(int) {
+				err := mycache.Once(&cache.Item{
+					Ctx: ctx,
+					Key: key,
+					Do: func(*cache.Item) (interface{}, error) {
+						time.Sleep(100 * time.Millisecond)
+						return obj, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			stats := mycache.Stats()
+			Expect(stats.Computed).To(Equal(uint64(1)))
+			Expect(stats.Shared).To(Equal(uint64(9)))
+		})
+
+		It("excludes operations from stats", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:        rdb,
+				LocalCache:   cache.NewTinyLFU(1000, time.Minute),
+				StatsEnabled: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.GetSkippingLocalCache(cache.WithoutStats(ctx), key, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Once(&cache.Item{
+				Ctx:       ctx,
+				Key:       "missing",
+				SkipStats: true,
+				Do: func(*cache.Item) (interface{}, error) {
+					return obj, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mycache.Stats()).To(Equal(&cache.Stats{}))
+
+			err = mycache.GetSkippingLocalCache(ctx, key, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mycache.Stats()).To(Equal(&cache.Stats{Hits: 1}))
+		})
+
+		It("keeps sub-second TTL with AllowSubSecondTTL", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:             rdb,
+				LocalCache:        cache.NewTinyLFU(1000, time.Minute),
+				AllowSubSecondTTL: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+				TTL:   250 * time.Millisecond,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := rdb.PTTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically(">", 0))
+			Expect(ttl).To(BeNumerically("<=", 250*time.Millisecond))
+		})
+
+		It("expires sub-second TTL with AllowSubSecondTTL", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:             rdb,
+				AllowSubSecondTTL: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+				TTL:   250 * time.Millisecond,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			time.Sleep(100 * time.Millisecond)
+			Expect(mycache.Exists(ctx, key)).To(BeTrue())
+
+			time.Sleep(200 * time.Millisecond)
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+		})
+
+		It("uses Options.BufferPool", func() {
+			for _, pool := range []cache.BufferPool{new(countingPool), cache.NoBufferPool} {
+				mycache = cache.New(&cache.Options{
+					Redis:      rdb,
+					LocalCache: cache.NewTinyLFU(1000, time.Minute),
+					BufferPool: pool,
+				})
+
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				wanted := new(Object)
+				err = mycache.Get(ctx, key, wanted)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(wanted).To(Equal(obj))
+
+				if pool, ok := pool.(*countingPool); ok {
+					Expect(atomic.LoadInt64(&pool.gets)).To(Equal(int64(1)))
+				}
+			}
+
+			// Compressed values are decompressed into a buffer from the pool.
+			obj.Str = strings.Repeat("my very large string", 10)
+			pool := new(countingPool)
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				BufferPool: pool,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+			Expect(atomic.LoadInt64(&pool.gets)).To(Equal(int64(2)))
+		})
+
+		It("Gets and Sets data compressed with zstd", func() {
+			obj.Str = strings.Repeat("my very large string", 10)
+
+			mycache = cache.New(&cache.Options{
+				Redis:       rdb,
+				LocalCache:  cache.NewTinyLFU(1000, time.Minute),
+				Compression: cache.CompressionZstd,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+		})
+
+		It("shares zstd encoders and decoders between caches", func() {
+			obj.Str = strings.Repeat("my very large string", 10)
+
+			roundTrip := func() {
+				mycache = cache.New(&cache.Options{
+					Redis:       rdb,
+					LocalCache:  cache.NewTinyLFU(1000, time.Minute),
+					Compression: cache.CompressionZstd,
+				})
+
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = mycache.Get(ctx, key, new(Object))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			roundTrip()
+			n := runtime.NumGoroutine()
+			for i := 0; i < 10; i++ {
+				roundTrip()
+			}
+			Expect(runtime.NumGoroutine()).To(BeNumerically("<=", n))
+		})
+
+		It("Gets and Sets data compressed with a zstd dictionary", func() {
+			obj.Str = strings.Repeat("my very large string", 10)
+
+			dict, err := ioutil.ReadFile("testdata/zstd.dict")
+			Expect(err).NotTo(HaveOccurred())
+
+			mycache = cache.New(&cache.Options{
+				Redis:           rdb,
+				LocalCache:      cache.NewTinyLFU(1000, time.Minute),
+				CompressionDict: dict,
+			})
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wanted := new(Object)
+			err = mycache.Get(ctx, key, wanted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wanted).To(Equal(obj))
+
+			err = cache.New(&cache.Options{Redis: rdb}).Get(ctx, key, wanted)
+			Expect(err).To(MatchError(ContainSubstring("Options.CompressionDict is not set")))
+		})
+
+		It("encodes equal maps into identical bytes with SortMapKeys", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:       rdb,
+				LocalCache:  cache.NewTinyLFU(1000, time.Minute),
+				SortMapKeys: true,
+			})
+
+			m := make(map[string]interface{})
+			for i := 0; i < 100; i++ {
+				m[fmt.Sprint(i)] = i
+			}
+
+			b1, err := mycache.Marshal(m)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 10; i++ {
+				b2, err := mycache.Marshal(m)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b2).To(Equal(b1))
+			}
+
+			var got map[string]interface{}
+			err = mycache.Unmarshal(b1, &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(100))
+		})
+
+		It("reports values that can't be marshaled", func() {
+			var reported []string
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				OnMarshalError: func(key string, value interface{}, err error) {
+					reported = append(reported, fmt.Sprintf("%s %T", key, value))
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: make(chan int),
+			})
+			Expect(err).To(MatchError(HavePrefix(`cache: can't marshal chan int for key="mykey": `)))
+			Expect(reported).To(Equal([]string{"mykey chan int"}))
+		})
+
+		It("calls OnMiss on a miss in both layers", func() {
+			var misses []string
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				OnMiss: func(key string) {
+					misses = append(misses, key)
+				},
+			})
+
+			err := mycache.Get(ctx, key, nil)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+			Expect(misses).To(Equal([]string{key}))
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Get(ctx, key, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(misses).To(HaveLen(1))
+
+			mycache.DeleteFromLocalCache(key)
+
+			err = mycache.Get(ctx, key, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(misses).To(HaveLen(1))
+		})
+
+		It("sets and gets values with readers", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:        rdb,
+				LocalCache:   cache.NewTinyLFU(1000, time.Minute),
+				MaxLocalSize: 64,
+			})
+
+			for _, data := range []string{"small", strings.Repeat("large", 100)} {
+				err := mycache.SetReader(ctx, key, strings.NewReader(data), time.Hour)
+				Expect(err).NotTo(HaveOccurred())
+
+				r, err := mycache.GetReader(ctx, key)
+				Expect(err).NotTo(HaveOccurred())
+				b, err := ioutil.ReadAll(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.Close()).NotTo(HaveOccurred())
+				Expect(string(b)).To(Equal(data))
+
+				_, ok := mycache.RawLocal(key)
+				Expect(ok).To(Equal(len(data) <= 64))
+			}
+		})
+
+		It("does one Redis read and one Do call for a cold key", func() {
+			counter := &getCounter{Ring: rdb}
+			mycache = cache.New(&cache.Options{
+				Redis:      counter,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+
+			var callCount int64
+			perform(100, func(int) {
+				got := new(Object)
+				err := mycache.Once(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: got,
+					Do: func(*cache.Item) (interface{}, error) {
+						time.Sleep(10 * time.Millisecond)
+						atomic.AddInt64(&callCount, 1)
+						return obj, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal(obj))
+			})
+			Expect(callCount).To(Equal(int64(1)))
+			Expect(atomic.LoadInt64(&counter.gets)).To(Equal(int64(1)))
+		})
+
+		It("derives Redis TTL from local TTL", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				RedisTTLFunc: func(localTTL time.Duration) time.Duration {
+					return 10 * localTTL
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key1",
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key2",
+				Value: obj,
+				TTL:   time.Hour,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := rdb.TTL(ctx, "key1").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(Equal(10 * time.Minute))
+
+			ttl, err = rdb.TTL(ctx, "key2").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(Equal(time.Hour))
+		})
+
+		It("skips local cache on Set with SkipLocalCacheOnSet", func() {
+			counter := &getCounter{Ring: rdb}
+			mycache = cache.New(&cache.Options{
+				Redis:               counter,
+				LocalCache:          cache.NewTinyLFU(1000, time.Minute),
+				SkipLocalCacheOnSet: true,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 2; i++ {
+				got := new(Object)
+				err = mycache.Get(ctx, key, got)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal(obj))
+				Expect(counter.gets).To(Equal(int64(1)))
+			}
+		})
+
+		It("skips unchanged writes with SkipUnchangedWrites", func() {
+			var names []string
+			mycache = cache.New(&cache.Options{
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				Redis: cache.InstrumentRediser(rdb, cache.Hooks{
+					OnCommand: func(_ context.Context, name string, _ time.Duration, _ error) {
+						names = append(names, name)
+					},
+				}),
+				SkipUnchangedWrites: true,
+			})
+
+			set := func() {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   key,
+					Value: obj,
+					TTL:   time.Hour,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			set()
+			set()
+			Expect(names).To(Equal([]string{"set", "pexpire"}))
+
+			Expect(rdb.Del(ctx, key).Err()).NotTo(HaveOccurred())
+			set()
+			Expect(names).To(Equal([]string{"set", "pexpire", "pexpire", "set"}))
+
+			ttl, err := rdb.TTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(Equal(time.Hour))
+		})
+
+		It("prefetches keys into local cache", func() {
+			counter := &getCounter{Ring: rdb}
+			mycache = cache.New(&cache.Options{
+				Redis:      counter,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: obj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			mycache.DeleteFromLocalCache(key)
+
+			err = mycache.PrefetchLocal(ctx, []string{key, "missing"})
+			Expect(err).NotTo(HaveOccurred())
+
+			got := new(Object)
+			err = mycache.Get(ctx, key, got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(obj))
+			Expect(counter.gets).To(Equal(int64(0)))
+
+			err = mycache.Get(ctx, "missing", got)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+			Expect(counter.gets).To(Equal(int64(1)))
+		})
+
+		It("repairs local cache from Redis", func() {
+			var errs []error
+			mycache = cache.New(&cache.Options{
+				Redis:          rdb,
+				LocalCache:     cache.NewTinyLFU(1000, time.Minute),
+				ReadRepairRate: 1,
+				OnError: func(err error) {
+					errs = append(errs, err)
+				},
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: "local",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var dst string
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal("local"))
+			Expect(errs).To(BeEmpty())
+
+			err = rdb.Set(ctx, key, "redis", time.Hour).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal("redis"))
+			Expect(errs).To(HaveLen(1))
+			Expect(errors.Is(errs[0], cache.ErrLocalCacheMismatch)).To(BeTrue())
+
+			err = rdb.Del(ctx, key).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = mycache.Get(ctx, key, &dst)
+			Expect(err).To(Equal(cache.ErrCacheMiss))
+			Expect(errs).To(HaveLen(2))
+		})
+
+		It("gives up when cached value keeps failing to decode", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:      &noDelRing{Ring: rdb},
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: int64(0),
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var callCount int64
+			var got bool
+			err = mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: &got,
+				Do: func(*cache.Item) (interface{}, error) {
+					atomic.AddInt64(&callCount, 1)
+					return true, nil
+				},
+			})
+			Expect(err).To(MatchError("msgpack: invalid code=0 decoding bool"))
+			Expect(callCount).To(Equal(int64(0)))
+		})
+
+		It("recovers panics in Do with RecoverFunc", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:       rdb,
+				LocalCache:  cache.NewTinyLFU(1000, time.Minute),
+				RecoverFunc: true,
+			})
+
+			var value string
+			err := mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: &value,
+				Do: func(*cache.Item) (interface{}, error) {
+					panic("boom")
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(`cache: Do for key="mykey" panicked: boom`))
+			Expect(err.Error()).To(ContainSubstring("goroutine"))
+
+			err = mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   key,
+				Value: &value,
+				Do: func(*cache.Item) (interface{}, error) {
+					return "hello", nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("hello"))
+		})
+
+		It("returns Fallback when Do fails", func() {
+			var reported []error
+			mycache = cache.New(&cache.Options{
+				Redis:      rdb,
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+				OnError: func(err error) {
+					reported = append(reported, err)
+				},
+			})
+
+			doErr := errors.New("backend is down")
+			var value string
+			err := mycache.Once(&cache.Item{
+				Ctx:      ctx,
+				Key:      key,
+				Value:    &value,
+				Fallback: "default",
+				Do: func(*cache.Item) (interface{}, error) {
+					return nil, doErr
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("default"))
+			Expect(reported).To(HaveLen(1))
+			Expect(errors.Is(reported[0], doErr)).To(BeTrue())
+			Expect(mycache.Exists(ctx, key)).To(BeFalse())
+
+			err = mycache.Once(&cache.Item{
+				Ctx:         ctx,
+				Key:         key,
+				Value:       &value,
+				Fallback:    "default",
+				FallbackTTL: time.Minute,
+				Do: func(*cache.Item) (interface{}, error) {
+					return nil, doErr
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("default"))
+			Expect(mycache.Exists(ctx, key)).To(BeTrue())
+
+			ttl, err := rdb.PTTL(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+		})
+
+		It("limits concurrent Do calls with MaxConcurrentFuncs", func() {
+			mycache = cache.New(&cache.Options{
+				LocalCache:         cache.NewTinyLFU(1000, time.Minute),
+				MaxConcurrentFuncs: 2,
+			})
+
+			var running, maxRunning int64
+			perform(10, func(i int) {
+				err := mycache.Once(&cache.Item{
+					Ctx: ctx,
+					Key: fmt.Sprintf("key%d", i),
+					Do: func(*cache.Item) (interface{}, error) {
+						n := atomic.AddInt64(&running, 1)
+						defer atomic.AddInt64(&running, -1)
+
+						for {
+							max := atomic.LoadInt64(&maxRunning)
+							if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+								break
+							}
+						}
+						time.Sleep(10 * time.Millisecond)
+						return i, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+			Expect(maxRunning).To(Equal(int64(2)))
+
+			block := make(chan struct{})
+			defer close(block)
+			for i := 0; i < 2; i++ {
+				go func(i int) {
+					_ = mycache.Once(&cache.Item{
+						Ctx: ctx,
+						Key: fmt.Sprintf("blocked%d", i),
+						Do: func(*cache.Item) (interface{}, error) {
+							<-block
+							return nil, nil
+						},
+					})
+				}(i)
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			err := mycache.Once(&cache.Item{
+				Ctx: canceled,
+				Key: key,
+				Do: func(*cache.Item) (interface{}, error) {
+					return nil, nil
+				},
+			})
+			Expect(err).To(Equal(context.DeadlineExceeded))
+
+			var loaded bool
+			load := func(missing []string) (map[string]interface{}, error) {
+				loaded = true
+				return nil, nil
+			}
+			dst := map[string]interface{}{"batched": new(Object)}
+			err = mycache.OnceBatch(canceled, []string{"batched"}, load, time.Hour, dst)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(loaded).To(BeFalse())
+		})
+
+		It("runs Once and OnceBatch called by Do in its MaxConcurrentFuncs slot", func() {
+			mycache = cache.New(&cache.Options{
+				LocalCache:         cache.NewTinyLFU(1000, time.Minute),
+				MaxConcurrentFuncs: 1,
+				BatchLoadSize:      1,
+			})
+
+			timeout, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+
+			load := func(missing []string) (map[string]interface{}, error) {
+				m := make(map[string]interface{}, len(missing))
+				for _, key := range missing {
+					m[key] = &Object{Str: key}
+				}
+				return m, nil
+			}
+
+			var value string
+			err := mycache.Once(&cache.Item{
+				Ctx:   timeout,
+				Key:   key,
+				Value: &value,
+				Do: func(item *cache.Item) (interface{}, error) {
+					dst := map[string]interface{}{
+						"key1": new(Object),
+						"key2": new(Object),
+					}
+					err := mycache.OnceBatch(item.Context(), []string{"key1", "key2"}, load, time.Hour, dst)
+					if err != nil {
+						return nil, err
+					}
+
+					var nested string
+					err = mycache.Once(&cache.Item{
+						Ctx:   item.Context(),
+						Key:   "nested",
+						Value: &nested,
 						Do: func(*cache.Item) (interface{}, error) {
-							return nil, io.EOF
+							return "nested", nil
 						},
 					})
-					Expect(err).To(Equal(io.EOF))
-					Expect(got).To(BeFalse())
+					if err != nil {
+						return nil, err
+					}
+					return dst["key1"].(*Object).Str + dst["key2"].(*Object).Str + nested, nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("key1key2nested"))
+		})
+
+		It("loads missing keys in chunks of BatchLoadSize", func() {
+			mycache = cache.New(&cache.Options{
+				Redis:              rdb,
+				LocalCache:         cache.NewTinyLFU(1000, time.Minute),
+				BatchLoadSize:      2,
+				MaxConcurrentFuncs: 2,
+			})
+
+			var mu sync.Mutex
+			var chunks [][]string
+			load := func(missing []string) (map[string]interface{}, error) {
+				mu.Lock()
+				chunks = append(chunks, missing)
+				mu.Unlock()
+
+				m := make(map[string]interface{}, len(missing))
+				for _, key := range missing {
+					m[key] = &Object{Str: key}
+				}
+				return m, nil
+			}
+
+			keys := []string{"key1", "key2", "key3", "key4", "key5"}
+			dst := make(map[string]interface{}, len(keys))
+			for _, key := range keys {
+				dst[key] = new(Object)
+			}
+
+			err := mycache.OnceBatch(ctx, keys, load, time.Hour, dst)
+			Expect(err).NotTo(HaveOccurred())
+			for _, key := range keys {
+				Expect(dst[key]).To(Equal(&Object{Str: key}))
+			}
+			Expect(chunks).To(ConsistOf(
+				[]string{"key1", "key2"},
+				[]string{"key3", "key4"},
+				[]string{"key5"},
+			))
+		})
+	})
+
+	Context("with LocalCache and without Redis", func() {
+		BeforeEach(func() {
+			rdb = nil
+			mycache = cache.New(&cache.Options{
+				LocalCache: cache.NewTinyLFU(1000, time.Minute),
+			})
+			hasLocalCache = true
+		})
+
+		testCache()
+	})
+
+	Context("with Redis shards", func() {
+		var shards []*redis.Client
+
+		BeforeEach(func() {
+			shards = newShards()
+			rdb = nil
+			mycache = cache.New(&cache.Options{
+				RedisShards: []redis.Cmdable{shards[0], shards[1]},
+			})
+			hasLocalCache = false
+		})
+
+		testCache()
+
+		It("distributes keys across shards", func() {
+			for i := 0; i < 100; i++ {
+				err := mycache.Set(&cache.Item{
+					Ctx:   ctx,
+					Key:   fmt.Sprintf("key%d", i),
+					Value: obj,
 				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			var total int64
+			for _, shard := range shards {
+				n, err := shard.DBSize(ctx).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(BeNumerically(">", 0))
+				total += n
+			}
+			Expect(total).To(Equal(int64(100)))
+
+			for i := 0; i < 100; i++ {
+				wanted := new(Object)
+				err := mycache.Get(ctx, fmt.Sprintf("key%d", i), wanted)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(wanted).To(Equal(obj))
+			}
+		})
+	})
+})
+
+var _ = Describe("NewLocalOnly", func() {
+	It("caches values locally", func() {
+		ctx := context.TODO()
+		mycache := cache.NewLocalOnly(100, time.Minute)
+
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var got string
+		err = mycache.Get(ctx, "key", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal("value"))
+
+		err = mycache.Get(ctx, "missing", &got)
+		Expect(err).To(Equal(cache.ErrCacheMiss))
+	})
+})
+
+var _ = Describe("without Redis and LocalCache", func() {
+	It("returns ErrNoBackend", func() {
+		ctx := context.TODO()
+		mycache := cache.New(&cache.Options{})
+
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(errors.Is(err, cache.ErrNoBackend)).To(BeTrue())
+
+		err = mycache.Get(ctx, "key", nil)
+		Expect(errors.Is(err, cache.ErrNoBackend)).To(BeTrue())
+
+		err = mycache.Delete(ctx, "key")
+		Expect(errors.Is(err, cache.ErrNoBackend)).To(BeTrue())
+	})
+})
+
+var _ = Describe("without Redis", func() {
+	It("returns ErrNoRedis from the methods that require Redis", func() {
+		ctx := context.TODO()
+		mycache := cache.NewLocalOnly(100, time.Minute)
+
+		err := mycache.GetSet(ctx, "key", "value", nil, time.Minute)
+		Expect(err).To(Equal(cache.ErrNoRedis))
+
+		err = mycache.Take(ctx, "key", nil)
+		Expect(err).To(Equal(cache.ErrNoRedis))
+
+		_, err = mycache.DecrementFloor(ctx, "key", 1, 0, time.Minute)
+		Expect(err).To(Equal(cache.ErrNoRedis))
+
+		_, err = mycache.GetWithTTL(ctx, "key", nil)
+		Expect(err).To(Equal(cache.ErrNoRedis))
+
+		_, err = mycache.RedisBytes(ctx, "key")
+		Expect(err).To(Equal(cache.ErrNoRedis))
+	})
+})
+
+var _ = Describe("Key", func() {
+	It("joins parts", func() {
+		Expect(cache.Key()).To(Equal(""))
+		Expect(cache.Key("user")).To(Equal("user"))
+		Expect(cache.Key("user", "42")).To(Equal("user:42"))
+	})
+
+	It("escapes the separator", func() {
+		Expect(cache.Key("a:b", "c")).To(Equal(`a\:b:c`))
+		Expect(cache.Key("a", "b:c")).To(Equal(`a:b\:c`))
+		Expect(cache.Key(`a\`, "b")).To(Equal(`a\\:b`))
+		Expect(cache.Key(`a\`, "b")).NotTo(Equal(cache.Key("a", ":b")))
+	})
+})
+
+var _ = Describe("TinyLFU", func() {
+	It("expires entries after ttl", func() {
+		lfu := cache.NewTinyLFU(100, 10*time.Millisecond)
+		lfu.UseRandomizedTTL(0)
+		lfu.Set("key", []byte("value"))
+
+		_, ok := lfu.Get("key")
+		Expect(ok).To(BeTrue())
+
+		time.Sleep(20 * time.Millisecond)
+
+		_, ok = lfu.Get("key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("reports evicted entries", func() {
+		var mu sync.Mutex
+		var evicted []string
+
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		mycache := cache.New(&cache.Options{
+			LocalCache: lfu,
+			OnLocalEvict: func(key string) {
+				mu.Lock()
+				evicted = append(evicted, key)
+				mu.Unlock()
+
+				_, ok := lfu.Get(key)
+				Expect(ok).To(BeFalse())
+			},
+		})
+
+		for i := 0; i < 2; i++ {
+			err := mycache.Set(&cache.Item{
+				Key:   "key",
+				Value: "value",
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		mu.Lock()
+		Expect(evicted).To(BeEmpty())
+		mu.Unlock()
+
+		err := mycache.Delete(context.TODO(), "key")
+		Expect(err).NotTo(HaveOccurred())
+		mu.Lock()
+		Expect(evicted).To(Equal([]string{"key"}))
+		mu.Unlock()
+
+		for i := 0; i < 1000; i++ {
+			lfu.Set(fmt.Sprintf("key%d", i), []byte("value"))
+		}
+		mu.Lock()
+		Expect(len(evicted)).To(BeNumerically(">", 1))
+		mu.Unlock()
+	})
+
+	It("expires entries using Options.Clock", func() {
+		clock := &fakeClock{now: time.Now()}
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		lfu.UseRandomizedTTL(0)
+		_ = cache.New(&cache.Options{
+			LocalCache: lfu,
+			Clock:      clock,
+		})
+		lfu.Set("key", []byte("value"))
+
+		clock.Add(time.Minute - time.Nanosecond)
+		_, ok := lfu.Get("key")
+		Expect(ok).To(BeTrue())
+
+		clock.Add(time.Nanosecond)
+		_, ok = lfu.Get("key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("deletes entries by prefix", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache:    cache.NewTinyLFU(100, time.Minute),
+			LocalKeyIndex: true,
+		})
+
+		for _, key := range []string{"user:1:name", "user:1:email", "user:12:name"} {
+			err := mycache.Set(&cache.Item{
+				Key:   key,
+				Value: "value",
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := mycache.DeleteFromLocalCacheByPrefix("user:1:")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(mycache.Exists(context.TODO(), "user:1:name")).To(BeFalse())
+		Expect(mycache.Exists(context.TODO(), "user:1:email")).To(BeFalse())
+		Expect(mycache.Exists(context.TODO(), "user:12:name")).To(BeTrue())
+	})
+
+	It("deletes entries by prefix after evictions", func() {
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		mycache := cache.New(&cache.Options{
+			LocalCache:    lfu,
+			LocalKeyIndex: true,
+		})
+
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("user:%d", i)
+			lfu.Set(key, []byte("value"))
+			lfu.Get(key)
+		}
+
+		err := mycache.DeleteFromLocalCacheByPrefix("user:")
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 1000; i++ {
+			_, ok := lfu.Get(fmt.Sprintf("user:%d", i))
+			Expect(ok).To(BeFalse())
+		}
+	})
+
+	It("requires LocalKeyIndex to delete by prefix", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache: cache.NewTinyLFU(100, time.Minute),
+		})
+		err := mycache.DeleteFromLocalCacheByPrefix("user:")
+		Expect(err).To(MatchError("cache: deleting by prefix requires Options.LocalKeyIndex"))
+	})
+
+	It("sets many entries at once", func() {
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		lfu.SetMany([]string{"key1", "key2"}, [][]byte{[]byte("value1"), []byte("value2")})
+
+		b, ok := lfu.Get("key1")
+		Expect(ok).To(BeTrue())
+		Expect(string(b)).To(Equal("value1"))
+
+		b, ok = lfu.Get("key2")
+		Expect(ok).To(BeTrue())
+		Expect(string(b)).To(Equal("value2"))
+	})
+
+	It("reports age of entries", func() {
+		clock := &fakeClock{now: time.Now()}
+		mycache := cache.New(&cache.Options{
+			LocalCache: cache.NewTinyLFU(100, time.Minute),
+			Clock:      clock,
+		})
+
+		_, err := mycache.Age(context.TODO(), "key")
+		Expect(err).To(Equal(cache.ErrCacheMiss))
+
+		err = mycache.Set(&cache.Item{
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		clock.Add(time.Second)
+
+		age, err := mycache.Age(context.TODO(), "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(age).To(Equal(time.Second))
+	})
+
+	It("reports unknown age of entries that are only in Redis", func() {
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		mycache := cache.New(&cache.Options{
+			Redis:      newRing(),
+			LocalCache: lfu,
+		})
+
+		_, err := mycache.Age(context.TODO(), "key")
+		Expect(err).To(Equal(cache.ErrCacheMiss))
+
+		err = mycache.Set(&cache.Item{
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		lfu.Del("key")
+
+		_, err = mycache.Age(context.TODO(), "key")
+		Expect(err).To(Equal(cache.ErrAgeUnknown))
+	})
+
+	It("expires entries that are not read for idle ttl", func() {
+		clock := &fakeClock{now: time.Now()}
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		_ = cache.New(&cache.Options{
+			LocalCache:        lfu,
+			LocalCacheIdleTTL: 50 * time.Millisecond,
+			Clock:             clock,
+		})
+		lfu.Set("key", []byte("value"))
+
+		for i := 0; i < 5; i++ {
+			clock.Add(40 * time.Millisecond)
+
+			_, ok := lfu.Get("key")
+			Expect(ok).To(BeTrue())
+		}
+
+		clock.Add(50 * time.Millisecond)
+
+		_, ok := lfu.Get("key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("expires entries older than LocalMaxAge despite idle ttl", func() {
+		clock := &fakeClock{now: time.Now()}
+		lfu := cache.NewTinyLFU(100, time.Minute)
+		_ = cache.New(&cache.Options{
+			LocalCache:        lfu,
+			LocalCacheIdleTTL: 50 * time.Millisecond,
+			LocalMaxAge:       100 * time.Millisecond,
+			Clock:             clock,
+		})
+		lfu.Set("key", []byte("value"))
+
+		for i := 0; i < 2; i++ {
+			clock.Add(40 * time.Millisecond)
+
+			_, ok := lfu.Get("key")
+			Expect(ok).To(BeTrue())
+		}
+
+		clock.Add(20 * time.Millisecond)
+
+		_, ok := lfu.Get("key")
+		Expect(ok).To(BeFalse())
+
+		_, ok = lfu.GetStale("key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("keeps LocalMaxAge and Age after TouchLocal", func() {
+		for _, verifyKey := range []bool{false, true} {
+			clock := &fakeClock{now: time.Now()}
+			lfu := cache.NewTinyLFU(100, 50*time.Millisecond)
+			lfu.UseRandomizedTTL(0)
+			mycache := cache.New(&cache.Options{
+				LocalCache:     lfu,
+				LocalMaxAge:    100 * time.Millisecond,
+				Clock:          clock,
+				VerifyLocalKey: verifyKey,
+			})
+
+			err := mycache.Set(&cache.Item{
+				Key:   "key",
+				Value: "value",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 1; i <= 2; i++ {
+				clock.Add(40 * time.Millisecond)
+				Expect(mycache.TouchLocal("key")).To(BeTrue())
+
+				age, err := mycache.Age(context.TODO(), "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(age).To(Equal(time.Duration(i) * 40 * time.Millisecond))
+			}
+
+			clock.Add(20 * time.Millisecond)
+			Expect(mycache.TouchLocal("key")).To(BeFalse())
+			Expect(mycache.Exists(context.TODO(), "key")).To(BeFalse())
+		}
+	})
+
+	It("does not corrupt values on concurrent Set and Get of the same key", func() {
+		for _, verifyKey := range []bool{false, true} {
+			mycache := cache.New(&cache.Options{
+				LocalCache:     cache.NewTinyLFU(100, time.Minute),
+				VerifyLocalKey: verifyKey,
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					value := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+					for j := 0; j < 200; j++ {
+						err := mycache.Set(&cache.Item{
+							Key:   "key",
+							Value: value,
+						})
+						Expect(err).NotTo(HaveOccurred())
+
+						var got []byte
+						err = mycache.Get(context.TODO(), "key", &got)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(got).To(HaveLen(1000))
+						Expect(bytes.Count(got, got[:1])).To(Equal(1000))
+					}
+				}(i)
+			}
+			wg.Wait()
+		}
+	})
+
+	It("does not expire entries when ttl is negative", func() {
+		lfu := cache.NewTinyLFU(100, -1)
+		lfu.Set("key", []byte("value"))
+
+		time.Sleep(20 * time.Millisecond)
+
+		b, ok := lfu.Get("key")
+		Expect(ok).To(BeTrue())
+		Expect(b).To(Equal([]byte("value")))
+	})
+})
+
+type Event struct {
+	Name string
+}
+
+type NotFoundError struct {
+	ID int
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%d is not found", e.ID)
+}
+
+func init() {
+	cache.RegisterType("event", func() interface{} {
+		return new(Event)
+	})
+	cache.RegisterType("not_found", func() interface{} {
+		return new(NotFoundError)
+	})
+}
+
+var _ = Describe("RegisterType", func() {
+	ctx := context.TODO()
+
+	It("decodes registered types into interface{}", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache: cache.NewTinyLFU(1000, time.Minute),
+		})
+
+		for _, value := range []interface{}{Event{Name: "hello"}, &Event{Name: "hello"}} {
+			err := mycache.Set(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key",
+				Value: value,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var got interface{}
+			err = mycache.Get(ctx, "key", &got)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(&Event{Name: "hello"}))
+
+			event := new(Event)
+			err = mycache.Get(ctx, "key", event)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(event).To(Equal(&Event{Name: "hello"}))
+		}
+	})
+
+	It("caches errors of registered types", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache: cache.NewTinyLFU(1000, time.Minute),
+		})
+
+		var callCount int
+		for i := 0; i < 2; i++ {
+			var value string
+			err := mycache.Once(&cache.Item{
+				Ctx:   ctx,
+				Key:   "key",
+				Value: &value,
+				Do: func(*cache.Item) (interface{}, error) {
+					callCount++
+					return nil, &NotFoundError{ID: 42}
+				},
+			})
+			Expect(err).To(Equal(&NotFoundError{ID: 42}))
+		}
+		Expect(callCount).To(Equal(1))
+
+		var value string
+		err := mycache.Get(ctx, "key", &value)
+		Expect(err).To(Equal(&NotFoundError{ID: 42}))
+
+		errs := mycache.GetBatch(ctx, []string{"key"}, []interface{}{&value})
+		Expect(errs).To(Equal([]error{&NotFoundError{ID: 42}}))
+
+		err = mycache.OnceBatch(ctx, []string{"key"}, func([]string) (map[string]interface{}, error) {
+			panic("not reached")
+		}, time.Minute, map[string]interface{}{"key": &value})
+		Expect(err).To(Equal(&NotFoundError{ID: 42}))
+
+		err = mycache.Once(&cache.Item{
+			Ctx: ctx,
+			Key: "other",
+			Do: func(*cache.Item) (interface{}, error) {
+				return nil, errors.New("not registered")
+			},
+		})
+		Expect(err).To(MatchError("not registered"))
+		Expect(mycache.Exists(ctx, "other")).To(BeFalse())
+	})
+
+	It("caches errors with NegativeTTL", func() {
+		ring := newRing()
+		mycache := cache.New(&cache.Options{
+			Redis:       ring,
+			NegativeTTL: time.Minute,
+		})
+
+		err := mycache.Once(&cache.Item{
+			Ctx: ctx,
+			Key: "key",
+			TTL: time.Hour,
+			Do: func(*cache.Item) (interface{}, error) {
+				return nil, &NotFoundError{ID: 42}
+			},
+		})
+		Expect(err).To(Equal(&NotFoundError{ID: 42}))
+
+		ttl, err := ring.PTTL(ctx, "key").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+	})
+
+	It("panics on duplicate names", func() {
+		Expect(func() {
+			cache.RegisterType("event", func() interface{} {
+				return new(Object)
+			})
+		}).To(Panic())
+	})
+})
+
+var _ = Describe("ServeStaleOnRedisError", func() {
+	ctx := context.TODO()
+
+	It("serves expired local value when Redis is down", func() {
+		var errs []error
+		lfu := cache.NewTinyLFU(1000, 10*time.Millisecond)
+		lfu.UseRandomizedTTL(0)
+		mycache := cache.New(&cache.Options{
+			Redis: redis.NewClient(&redis.Options{
+				Addr:       ":1",
+				MaxRetries: -1,
+			}),
+			LocalCache:             lfu,
+			ServeStaleOnRedisError: true,
+			OnError: func(err error) {
+				errs = append(errs, err)
+			},
+		})
+
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).To(HaveOccurred())
+
+		time.Sleep(20 * time.Millisecond)
+
+		var got string
+		err = mycache.Get(ctx, "key", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal("value"))
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0]).To(MatchError(ContainSubstring(`serving stale local value for key="key"`)))
+
+		err = mycache.Get(ctx, "missing", &got)
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(Equal(cache.ErrCacheMiss))
+	})
 
-				var got bool
-				err := mycache.Get(ctx, key, &got)
-				Expect(err).To(Equal(cache.ErrCacheMiss))
+	It("serves expired local value when Redis read times out", func() {
+		var errs []error
+		clock := &fakeClock{now: time.Now()}
+		lfu := cache.NewTinyLFU(1000, time.Minute)
+		lfu.UseRandomizedTTL(0)
+		mycache := cache.New(&cache.Options{
+			Redis: &slowRedis{Client: redis.NewClient(&redis.Options{
+				Addr: ":6379",
+			})},
+			LocalCache:             lfu,
+			Clock:                  clock,
+			ReadTimeout:            10 * time.Millisecond,
+			ServeStaleOnRedisError: true,
+			OnError: func(err error) {
+				errs = append(errs, err)
+			},
+		})
 
-				err = mycache.Once(&cache.Item{
-					Ctx:   ctx,
-					Key:   key,
-					Value: &got,
-					Do: func(*cache.Item) (interface{}, error) {
-						return true, nil
-					},
-				})
-				Expect(err).NotTo(HaveOccurred())
-				Expect(got).To(BeTrue())
-			})
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-			It("works with Value", func() {
-				var callCount int64
-				perform(100, func(int) {
-					got := new(Object)
-					err := mycache.Once(&cache.Item{
-						Ctx:   ctx,
-						Key:   key,
-						Value: got,
-						Do: func(*cache.Item) (interface{}, error) {
-							atomic.AddInt64(&callCount, 1)
-							return obj, nil
-						},
-					})
-					Expect(err).NotTo(HaveOccurred())
-					Expect(got).To(Equal(obj))
-				})
-				Expect(callCount).To(Equal(int64(1)))
-			})
+		clock.Add(time.Minute)
 
-			It("works with ptr and non-ptr", func() {
-				var callCount int64
-				perform(100, func(int) {
-					got := new(Object)
-					err := mycache.Once(&cache.Item{
-						Ctx:   ctx,
-						Key:   key,
-						Value: got,
-						Do: func(*cache.Item) (interface{}, error) {
-							atomic.AddInt64(&callCount, 1)
-							return *obj, nil
-						},
-					})
-					Expect(err).NotTo(HaveOccurred())
-					Expect(got).To(Equal(obj))
-				})
-				Expect(callCount).To(Equal(int64(1)))
-			})
+		var got string
+		err = mycache.Get(ctx, "key", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal("value"))
+		Expect(errs).To(HaveLen(1))
+		Expect(errors.Is(errs[0], context.DeadlineExceeded)).To(BeTrue())
+	})
 
-			It("works with bool", func() {
-				var callCount int64
-				perform(100, func(int) {
-					var got bool
-					err := mycache.Once(&cache.Item{
-						Ctx:   ctx,
-						Key:   key,
-						Value: &got,
-						Do: func(*cache.Item) (interface{}, error) {
-							atomic.AddInt64(&callCount, 1)
-							return true, nil
-						},
-					})
-					Expect(err).NotTo(HaveOccurred())
-					Expect(got).To(BeTrue())
-				})
-				Expect(callCount).To(Equal(int64(1)))
-			})
+	It("reports stale values with GetAllowStale", func() {
+		clock := &fakeClock{now: time.Now()}
+		lfu := cache.NewTinyLFU(1000, time.Minute)
+		lfu.UseRandomizedTTL(0)
+		mycache := cache.New(&cache.Options{
+			Redis: redis.NewClient(&redis.Options{
+				Addr:       ":1",
+				MaxRetries: -1,
+			}),
+			LocalCache: lfu,
+			Clock:      clock,
+		})
 
-			It("works without Value and nil result", func() {
-				var callCount int64
-				perform(100, func(int) {
-					err := mycache.Once(&cache.Item{
-						Ctx: ctx,
-						Key: key,
-						Do: func(*cache.Item) (interface{}, error) {
-							atomic.AddInt64(&callCount, 1)
-							return nil, nil
-						},
-					})
-					Expect(err).NotTo(HaveOccurred())
-				})
-				Expect(callCount).To(Equal(int64(1)))
-			})
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key",
+			Value: "value",
+		})
+		Expect(err).To(HaveOccurred())
 
-			It("works without Value and error result", func() {
-				var callCount int64
-				perform(100, func(int) {
-					err := mycache.Once(&cache.Item{
-						Ctx: ctx,
-						Key: key,
-						Do: func(*cache.Item) (interface{}, error) {
-							time.Sleep(100 * time.Millisecond)
-							atomic.AddInt64(&callCount, 1)
-							return nil, errors.New("error stub")
-						},
-					})
-					Expect(err).To(MatchError("error stub"))
-				})
-				Expect(callCount).To(Equal(int64(1)))
-			})
+		var got string
+		stale, err := mycache.GetAllowStale(ctx, "key", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stale).To(BeFalse())
+		Expect(got).To(Equal("value"))
 
-			It("does not cache error result", func() {
-				var callCount int64
-				do := func(sleep time.Duration) (int, error) {
-					var n int
-					err := mycache.Once(&cache.Item{
-						Ctx:   ctx,
-						Key:   key,
-						Value: &n,
-						Do: func(*cache.Item) (interface{}, error) {
-							time.Sleep(sleep)
+		clock.Add(time.Minute)
 
-							n := atomic.AddInt64(&callCount, 1)
-							if n == 1 {
-								return nil, errors.New("error stub")
-							}
-							return 42, nil
-						},
-					})
-					if err != nil {
-						return 0, err
-					}
-					return n, nil
-				}
+		got = ""
+		stale, err = mycache.GetAllowStale(ctx, "key", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stale).To(BeTrue())
+		Expect(got).To(Equal("value"))
 
-				perform(100, func(int) {
-					n, err := do(100 * time.Millisecond)
-					Expect(err).To(MatchError("error stub"))
-					Expect(n).To(Equal(0))
-				})
+		err = mycache.Get(ctx, "key", &got)
+		Expect(err).To(HaveOccurred())
+	})
+})
 
-				perform(100, func(int) {
-					n, err := do(0)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(n).To(Equal(42))
-				})
+var _ = Describe("Stats", func() {
+	It("adds and encodes stats", func() {
+		stats := &cache.Stats{Hits: 1, Misses: 2, SlowOps: 3, Computed: 4, Shared: 5, Errors: 6}
+		stats.Add(&cache.Stats{Hits: 10, Misses: 20, SlowOps: 30, Computed: 40, Shared: 500, Errors: 60})
+		Expect(stats).To(Equal(&cache.Stats{
+			Hits: 11, Misses: 22, SlowOps: 33, Computed: 44, Shared: 505, Errors: 66,
+		}))
 
-				Expect(callCount).To(Equal(int64(2)))
-			})
+		b, err := stats.MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b).To(HaveLen(8))
 
-			It("skips Set when TTL = -1", func() {
-				key := "skip-set"
+		got := new(cache.Stats)
+		err = got.UnmarshalBinary(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(stats))
 
-				var value string
-				err := mycache.Once(&cache.Item{
-					Ctx:   ctx,
-					Key:   key,
-					Value: &value,
-					Do: func(item *cache.Item) (interface{}, error) {
-						item.TTL = -1
-						return "hello", nil
-					},
-				})
-				Expect(err).NotTo(HaveOccurred())
-				Expect(value).To(Equal("hello"))
+		// Stats encoded before Errors was added.
+		err = got.UnmarshalBinary(b[:7])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Shared).To(Equal(uint64(505)))
+		Expect(got.Errors).To(BeZero())
 
-				if rdb != nil {
-					exists, err := rdb.Exists(ctx, key).Result()
-					Expect(err).NotTo(HaveOccurred())
-					Expect(exists).To(Equal(int64(0)))
-				}
-			})
+		err = got.UnmarshalBinary([]byte{0xff})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("counts Redis errors separately from misses", func() {
+		mycache := cache.New(&cache.Options{
+			Redis: &slowRedis{Client: redis.NewClient(&redis.Options{
+				Addr: ":6379",
+			})},
+			ReadTimeout:  10 * time.Millisecond,
+			StatsEnabled: true,
 		})
-	}
 
-	BeforeEach(func() {
-		obj = &Object{
-			Str: "mystring",
-			Num: 42,
-		}
+		err := mycache.Get(context.TODO(), "key", nil)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+		stats := mycache.Stats()
+		Expect(stats.Errors).To(Equal(uint64(1)))
+		Expect(stats.Misses).To(BeZero())
 	})
 
-	Context("without LocalCache", func() {
-		BeforeEach(func() {
-			rdb = newRing()
-			mycache = newCache(rdb)
+	It("applies ReadTimeout and ObserveLatency to GetWithTTL", func() {
+		var observed []string
+		mycache := cache.New(&cache.Options{
+			Redis: &slowRedis{Client: redis.NewClient(&redis.Options{
+				Addr: ":6379",
+			})},
+			ReadTimeout: 10 * time.Millisecond,
+			ObserveLatency: func(op, layer string, _ time.Duration) {
+				observed = append(observed, op+"/"+layer)
+			},
 		})
 
-		testCache()
+		_, err := mycache.GetWithTTL(context.TODO(), "key", nil)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(observed).To(Equal([]string{"get/redis"}))
 	})
 
-	Context("with LocalCache", func() {
-		BeforeEach(func() {
-			rdb = newRing()
-			mycache = newCacheWithLocal(rdb)
+	It("applies ReadTimeout to GetBatch", func() {
+		mycache := cache.New(&cache.Options{
+			Redis: &slowRedis{Client: redis.NewClient(&redis.Options{
+				Addr: ":6379",
+			})},
+			ReadTimeout: 10 * time.Millisecond,
 		})
 
-		testCache()
+		errs := mycache.GetBatch(context.TODO(), []string{"key"}, []interface{}{nil})
+		Expect(errs).To(HaveLen(1))
+		Expect(errors.Is(errs[0], context.DeadlineExceeded)).To(BeTrue())
 	})
 
-	Context("with LocalCache and without Redis", func() {
-		BeforeEach(func() {
-			rdb = nil
-			mycache = cache.New(&cache.Options{
-				LocalCache: cache.NewTinyLFU(1000, time.Minute),
-			})
+	It("counts GetWithTTL transport errors", func() {
+		mycache := cache.New(&cache.Options{
+			Redis: redis.NewClient(&redis.Options{
+				Addr:       ":1",
+				MaxRetries: -1,
+			}),
+			StatsEnabled: true,
 		})
 
-		testCache()
+		_, err := mycache.GetWithTTL(context.TODO(), "key", nil)
+		Expect(err).To(HaveOccurred())
+
+		stats := mycache.Stats()
+		Expect(stats.Errors).To(Equal(uint64(1)))
+		Expect(stats.Misses).To(BeZero())
+	})
+})
+
+var _ = Describe("Tiered", func() {
+	It("promotes hits to upper tiers", func() {
+		l1 := cache.NewTinyLFU(100, time.Minute)
+		l2 := cache.NewTinyLFU(1000, time.Hour)
+		tiered := cache.NewTiered(l1, l2)
+
+		tiered.Set("key", []byte("value"))
+		l1.Del("key")
+
+		_, ok := l1.Get("key")
+		Expect(ok).To(BeFalse())
+
+		b, ok := tiered.Get("key")
+		Expect(ok).To(BeTrue())
+		Expect(b).To(Equal([]byte("value")))
+
+		b, ok = l1.Get("key")
+		Expect(ok).To(BeTrue())
+		Expect(b).To(Equal([]byte("value")))
+
+		tiered.Del("key")
+		_, ok = l2.Get("key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("passes the optional methods to the tiers", func() {
+		clock := &fakeClock{now: time.Now()}
+		l1 := cache.NewTinyLFU(100, time.Minute)
+		l2 := cache.NewTinyLFU(1000, time.Hour)
+		l1.UseRandomizedTTL(0)
+		l2.UseRandomizedTTL(0)
+		mycache := cache.New(&cache.Options{
+			LocalCache:    cache.NewTiered(l1, l2),
+			Clock:         clock,
+			LocalKeyIndex: true,
+		})
+
+		err := mycache.Set(&cache.Item{
+			Key:   "config:a",
+			Value: "value",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		clock.Add(2 * time.Minute)
+		_, ok := l1.Get("config:a")
+		Expect(ok).To(BeFalse())
+
+		age, err := mycache.Age(context.TODO(), "config:a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(age).To(Equal(2 * time.Minute))
+
+		err = mycache.DeleteFromLocalCacheByPrefix("config:")
+		Expect(err).NotTo(HaveOccurred())
+		_, ok = l2.Get("config:a")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("VerifyLocalKey", func() {
+	ctx := context.TODO()
+
+	It("treats an entry stored for another key as a miss", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache:     new(oneSlotCache),
+			VerifyLocalKey: true,
+		})
+
+		err := mycache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   "key1",
+			Value: "value1",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var got string
+		err = mycache.Get(ctx, "key2", &got)
+		Expect(err).To(Equal(cache.ErrCacheMiss))
+
+		err = mycache.Get(ctx, "key1", &got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal("value1"))
 	})
 })
 
@@ -412,6 +3932,18 @@ func newRing() *redis.Ring {
 	return ring
 }
 
+func newShards() []*redis.Client {
+	ctx := context.TODO()
+	shards := []*redis.Client{
+		redis.NewClient(&redis.Options{Addr: ":6379"}),
+		redis.NewClient(&redis.Options{Addr: ":6380"}),
+	}
+	for _, shard := range shards {
+		_ = shard.FlushDB(ctx).Err()
+	}
+	return shards
+}
+
 func newCache(rdb *redis.Ring) *cache.Cache {
 	return cache.New(&cache.Options{
 		Redis: rdb,
@@ -424,3 +3956,104 @@ func newCacheWithLocal(rdb *redis.Ring) *cache.Cache {
 		LocalCache: cache.NewTinyLFU(1000, time.Minute),
 	})
 }
+
+type getCounter struct {
+	*redis.Ring
+	gets int64
+}
+
+func (c *getCounter) Get(ctx context.Context, key string) *redis.StringCmd {
+	atomic.AddInt64(&c.gets, 1)
+	return c.Ring.Get(ctx, key)
+}
+
+// noDelRing ignores deletes, so a corrupt value can't be removed.
+type noDelRing struct {
+	*redis.Ring
+}
+
+func (r *noDelRing) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+// slowRedis blocks reads until the context is done.
+type slowRedis struct {
+	*redis.Client
+}
+
+func (r *slowRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	<-ctx.Done()
+	return redis.NewStringResult("", ctx.Err())
+}
+
+func (r *slowRedis) Pipelined(
+	ctx context.Context, fn func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// countingPool counts the buffers taken from the pool.
+type countingPool struct {
+	bufpool.Pool
+	gets int64
+}
+
+func (p *countingPool) Get() *bufpool.Buffer {
+	atomic.AddInt64(&p.gets, 1)
+	return p.Pool.Get()
+}
+
+// oneSlotCache is a local cache where all keys collide.
+type oneSlotCache struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (c *oneSlotCache) Set(key string, b []byte) {
+	c.mu.Lock()
+	c.b = b
+	c.mu.Unlock()
+}
+
+func (c *oneSlotCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.b, c.b != nil
+}
+
+func (c *oneSlotCache) Del(key string) {
+	c.mu.Lock()
+	c.b = nil
+	c.mu.Unlock()
+}
+
+type BinaryObject struct {
+	Num int
+}
+
+func (o *BinaryObject) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("num=%d", o.Num)), nil
+}
+
+func (o *BinaryObject) UnmarshalBinary(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "num=%d", &o.Num)
+	return err
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+)
+
+// ContextCache is a view of a Cache bound to a context. It shares the
+// underlying clients, in-flight calls, and stats with the Cache.
+type ContextCache struct {
+	cd  *Cache
+	ctx context.Context
+}
+
+// WithContext returns a view of the cache that uses ctx for every operation
+// and for items that don't have their own Ctx.
+func (cd *Cache) WithContext(ctx context.Context) *ContextCache {
+	if ctx == nil {
+		panic("nil context")
+	}
+	return &ContextCache{
+		cd:  cd,
+		ctx: ctx,
+	}
+}
+
+// Context returns the context the view is bound to.
+func (c *ContextCache) Context() context.Context {
+	return c.ctx
+}
+
+func (c *ContextCache) item(item *Item) *Item {
+	if item.Ctx != nil {
+		return item
+	}
+	cp := *item
+	cp.Ctx = c.ctx
+	return &cp
+}
+
+// Set caches the item.
+func (c *ContextCache) Set(item *Item) error {
+	return c.cd.Set(c.item(item))
+}
+
+// Exists reports whether value for the given key exists.
+func (c *ContextCache) Exists(key string) bool {
+	return c.cd.Exists(c.ctx, key)
+}
+
+// Get gets the value for the given key.
+func (c *ContextCache) Get(key string, value interface{}) error {
+	return c.cd.Get(c.ctx, key, value)
+}
+
+// Once is like Cache.Once.
+func (c *ContextCache) Once(item *Item) error {
+	return c.cd.Once(c.item(item))
+}
+
+// Delete deletes the key from both layers.
+func (c *ContextCache) Delete(key string) error {
+	return c.cd.Delete(c.ctx, key)
+}
@@ -0,0 +1,489 @@
+package cache
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/bufpool"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoded values are prefixed with a small header that describes how the
+// payload was produced:
+//
+//	magic | encoding | compression | flags | payload
+//
+// The magic byte is 0xc1, which is never used by msgpack. In the older v8
+// layout the msgpack payload is followed by a single compression byte, so an
+// uncompressed legacy value never starts with it. An s2 compressed one starts
+// with the uvarint of the decoded length, which is 0xc1 and a valid encoding
+// 0x01-0x06 for the lengths 65+128*n, e.g. 193 bytes. The s2 block that
+// follows starts with a literal tag, and the only tag that is also a valid
+// compression is 0x00, a single byte literal. That byte would be the flags,
+// so the payload would start with a positive fixint 0x00-0x03, which is
+// a whole msgpack value of one byte and not the start of a longer one.
+// So parseHeader rejects every legacy value. Strings and byte slices are
+// stored as is and carry no header.
+//
+// If the version flag is set, the header is followed by the big-endian
+// uint16 Item.Version the value was stored with. The error flag marks a
+// typed value that is an error returned by Item.Do.
+const (
+	headerMagic = 0xc1
+	headerLen   = 4
+
+	versionFlag = 0x1
+	versionLen  = 2
+	errorFlag   = 0x2
+)
+
+const (
+	msgpackEncoding = 0x1
+	binaryEncoding  = 0x2
+	textEncoding    = 0x3
+	timeEncoding    = 0x4
+	ipEncoding      = 0x5
+	// typedEncoding is msgpack preceded by the uvarint length
+	// and the name of a type registered with RegisterType.
+	typedEncoding = 0x6
+)
+
+// nilValue is stored for an intentionally cached nil so that it can be told
+// apart from a missing key or a value written by someone else as an empty
+// string. A lone 0xc1 is neither valid msgpack nor valid UTF-8.
+const nilValue = headerMagic
+
+func isNilValue(b []byte) bool {
+	return len(b) == 1 && b[0] == nilValue
+}
+
+// Byte slices and strings are stored as is, so a raw value that consists of
+// 0xc1 bytes only gets one more to tell it apart from nilValue.
+func escapeRaw(b []byte) []byte {
+	if onlyNilValues(b) {
+		return append(b, nilValue)
+	}
+	return b
+}
+
+func unescapeRaw(b []byte) []byte {
+	if len(b) > 1 && onlyNilValues(b) {
+		return b[:len(b)-1]
+	}
+	return b
+}
+
+func onlyNilValues(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c != nilValue {
+			return false
+		}
+	}
+	return true
+}
+
+type header struct {
+	encoding    byte
+	compression byte
+	flags       byte
+	version     uint16
+}
+
+func (h *header) put(b []byte) {
+	b[0] = headerMagic
+	b[1] = h.encoding
+	b[2] = h.compression
+	b[3] = h.flags
+}
+
+// parseHeader returns the header and the payload that follows it. It reports
+// false if b does not start with a header this version understands.
+func parseHeader(b []byte) (header, []byte, bool) {
+	if len(b) < headerLen || b[0] != headerMagic {
+		return header{}, nil, false
+	}
+
+	h := header{
+		encoding:    b[1],
+		compression: b[2],
+		flags:       b[3],
+	}
+	if !h.valid() {
+		return header{}, nil, false
+	}
+
+	b = b[headerLen:]
+	if h.flags&versionFlag != 0 {
+		if len(b) < versionLen {
+			return header{}, nil, false
+		}
+		h.version = binary.BigEndian.Uint16(b)
+		b = b[versionLen:]
+	}
+	return h, b, true
+}
+
+// setVersion returns the encoded value with the version added to the
+// header. Values without a header are returned as is.
+func setVersion(b []byte, version uint16) []byte {
+	h, payload, ok := parseHeader(b)
+	if !ok {
+		return b
+	}
+	h.flags |= versionFlag
+
+	out := make([]byte, headerLen+versionLen+len(payload))
+	h.put(out)
+	binary.BigEndian.PutUint16(out[headerLen:], version)
+	copy(out[headerLen+versionLen:], payload)
+	return out
+}
+
+// versionMatches reports whether the encoded value was stored with the
+// version. Values without a header can't carry a version and always match.
+func versionMatches(b []byte, version uint16) bool {
+	h, _, ok := parseHeader(b)
+	if !ok {
+		return true
+	}
+	return h.version == version
+}
+
+func (h *header) valid() bool {
+	switch h.encoding {
+	case msgpackEncoding, binaryEncoding, textEncoding, timeEncoding, ipEncoding,
+		typedEncoding:
+	default:
+		return false
+	}
+
+	switch h.compression {
+	case noCompression, s2Compression, zstdCompression, zstdDictCompression:
+	default:
+		return false
+	}
+
+	return h.flags&^(versionFlag|errorFlag) == 0
+}
+
+// Compression is the compression method for encoded values.
+type Compression uint8
+
+const (
+	// CompressionS2 is the default.
+	CompressionS2 Compression = iota
+	CompressionZstd
+)
+
+// compress prefixes data with the header and compresses it. If force is
+// not nil, it decides whether data is compressed instead of its size.
+func (cd *Cache) compress(h header, data []byte, force *bool) []byte {
+	switch {
+	case force != nil && !*force:
+		h.compression = noCompression
+	case cd.zstdDict:
+		// Values compressed with a dictionary are usually small,
+		// so the threshold does not apply.
+		h.compression = zstdDictCompression
+	case force == nil && len(data) < compressionThreshold:
+		h.compression = noCompression
+	case cd.zstdEnc != nil:
+		h.compression = zstdCompression
+	default:
+		h.compression = s2Compression
+	}
+
+	var b []byte
+	switch h.compression {
+	case s2Compression:
+		b = make([]byte, headerLen+s2.MaxEncodedLen(len(data)))
+		h.put(b)
+		encoded := s2.Encode(b[headerLen:], data)
+		b = b[:headerLen+len(encoded)]
+	case zstdCompression, zstdDictCompression:
+		b = make([]byte, headerLen, headerLen+len(data))
+		h.put(b)
+		b = cd.zstdEnc.EncodeAll(data, b)
+	}
+
+	// Compression can make small or random data larger,
+	// so store whichever is smaller.
+	if b != nil && len(b)-headerLen < len(data) {
+		return b
+	}
+
+	h.compression = noCompression
+	b = make([]byte, headerLen+len(data))
+	h.put(b)
+	copy(b[headerLen:], data)
+	return b
+}
+
+// decompress decodes the payload using the given compression method.
+// The returned buffer, if not nil, must be returned to the pool once
+// the data is no longer used.
+func (cd *Cache) decompress(compression byte, b []byte) ([]byte, *bufpool.Buffer, error) {
+	switch compression {
+	case noCompression:
+		return b, nil, nil
+	case s2Compression:
+		n, err := s2.DecodedLen(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buf := cd.bufpool.Get()
+		buf.Grow(n)
+
+		b, err = s2.Decode(buf.Bytes(), b)
+		if err != nil {
+			cd.bufpool.Put(buf)
+			return nil, nil, err
+		}
+		return b, buf, nil
+	case zstdCompression, zstdDictCompression:
+		if compression == zstdDictCompression && !cd.zstdDict {
+			return nil, nil, errors.New("cache: value is compressed with a zstd dictionary, " +
+				"but Options.CompressionDict is not set")
+		}
+
+		dec, err := cd.zstdDecoder()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b, err = dec.DecodeAll(b, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return b, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown compression method: %x", compression)
+	}
+}
+
+func (cd *Cache) zstdDecoder() (*zstd.Decoder, error) {
+	cd.zstdDecOnce.Do(func() {
+		cd.zstdDec, cd.zstdDecErr = zstdDecoder(cd.opt.CompressionDict)
+	})
+	return cd.zstdDec, cd.zstdDecErr
+}
+
+// zstd encoders and decoders keep goroutines running until they are closed,
+// so they are shared by all caches with the same dictionary instead.
+var zstdCoders struct {
+	mu  sync.Mutex
+	enc map[string]*zstd.Encoder
+	dec map[string]*zstd.Decoder
+}
+
+func zstdEncoder(dict []byte) (*zstd.Encoder, error) {
+	zstdCoders.mu.Lock()
+	defer zstdCoders.mu.Unlock()
+
+	if enc, ok := zstdCoders.enc[string(dict)]; ok {
+		return enc, nil
+	}
+
+	var opts []zstd.EOption
+	if dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if zstdCoders.enc == nil {
+		zstdCoders.enc = make(map[string]*zstd.Encoder)
+	}
+	zstdCoders.enc[string(dict)] = enc
+	return enc, nil
+}
+
+func zstdDecoder(dict []byte) (*zstd.Decoder, error) {
+	zstdCoders.mu.Lock()
+	defer zstdCoders.mu.Unlock()
+
+	if dec, ok := zstdCoders.dec[string(dict)]; ok {
+		return dec, nil
+	}
+
+	var opts []zstd.DOption
+	if dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if zstdCoders.dec == nil {
+		zstdCoders.dec = make(map[string]*zstd.Decoder)
+	}
+	zstdCoders.dec[string(dict)] = dec
+	return dec, nil
+}
+
+// splitLegacy splits a value written before headers were introduced into
+// the compression method and the payload.
+func splitLegacy(b []byte) (byte, []byte) {
+	return b[len(b)-1], b[:len(b)-1]
+}
+
+// isJSON reports whether b is a JSON object, array or string. Values in the
+// legacy format are never valid JSON, because they end with the compression
+// byte.
+func isJSON(b []byte) bool {
+	switch b[0] {
+	case '{', '[', '"':
+		return json.Valid(b)
+	default:
+		return false
+	}
+}
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Reader)
+	},
+}
+
+// unmarshalMsgpack is like msgpack.Unmarshal, but reuses the reader so a
+// local cache hit does not allocate one per call.
+func unmarshalMsgpack(b []byte, value interface{}) error {
+	r := readerPool.Get().(*bytes.Reader)
+	r.Reset(b)
+
+	dec := msgpack.GetDecoder()
+	dec.Reset(r)
+	err := dec.Decode(value)
+	msgpack.PutDecoder(dec)
+
+	r.Reset(nil)
+	readerPool.Put(r)
+
+	return err
+}
+
+func unmarshalBinary(b []byte, value interface{}) error {
+	u, ok := value.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cache: %T does not implement encoding.BinaryUnmarshaler", value)
+	}
+	return u.UnmarshalBinary(b)
+}
+
+func unmarshalText(b []byte, value interface{}) error {
+	u, ok := value.(encoding.TextUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cache: %T does not implement encoding.TextUnmarshaler", value)
+	}
+	return u.UnmarshalText(b)
+}
+
+// time.Time is stored like the msgpack timestamp extension: 4 bytes of
+// seconds when there are no nanoseconds, 8 bytes of 30-bit nanoseconds and
+// 34-bit seconds when that fits, and 12 bytes otherwise. The location is not
+// stored and, as with msgpack, times are decoded in the local time zone and
+// the zero time in UTC.
+func marshalTime(tm time.Time) []byte {
+	h := header{encoding: timeEncoding}
+
+	sec := uint64(tm.Unix())
+	if sec>>34 == 0 {
+		data := uint64(tm.Nanosecond())<<34 | sec
+		if data&0xffffffff00000000 == 0 {
+			b := make([]byte, headerLen+4)
+			h.put(b)
+			binary.BigEndian.PutUint32(b[headerLen:], uint32(data))
+			return b
+		}
+
+		b := make([]byte, headerLen+8)
+		h.put(b)
+		binary.BigEndian.PutUint64(b[headerLen:], data)
+		return b
+	}
+
+	b := make([]byte, headerLen+12)
+	h.put(b)
+	binary.BigEndian.PutUint32(b[headerLen:], uint32(tm.Nanosecond()))
+	binary.BigEndian.PutUint64(b[headerLen+4:], sec)
+	return b
+}
+
+func unmarshalTime(b []byte, value interface{}) error {
+	var tm time.Time
+	switch len(b) {
+	case 4:
+		tm = time.Unix(int64(binary.BigEndian.Uint32(b)), 0)
+	case 8:
+		data := binary.BigEndian.Uint64(b)
+		tm = time.Unix(int64(data&0x00000003ffffffff), int64(data>>34))
+	case 12:
+		nsec := binary.BigEndian.Uint32(b)
+		sec := binary.BigEndian.Uint64(b[4:])
+		tm = time.Unix(int64(sec), int64(nsec))
+	default:
+		return fmt.Errorf("cache: invalid time length: %d", len(b))
+	}
+	if tm.IsZero() {
+		// Keep the location UTC, like time.Time{}.
+		tm = tm.UTC()
+	}
+
+	switch value := value.(type) {
+	case *time.Time:
+		*value = tm
+	case *interface{}:
+		*value = tm
+	default:
+		return fmt.Errorf("cache: can't decode time into %T", value)
+	}
+	return nil
+}
+
+// net.IP is stored in its 4-byte form when possible.
+func marshalIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b := make([]byte, headerLen+len(ip))
+	h := header{encoding: ipEncoding}
+	h.put(b)
+	copy(b[headerLen:], ip)
+	return b
+}
+
+func unmarshalIP(b []byte, value interface{}) error {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return fmt.Errorf("cache: invalid IP length: %d", len(b))
+	}
+
+	ip := make(net.IP, len(b))
+	copy(ip, b)
+
+	switch value := value.(type) {
+	case *net.IP:
+		*value = ip
+	case *interface{}:
+		*value = ip
+	default:
+		return fmt.Errorf("cache: can't decode IP into %T", value)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// OnceValue is like Once, but returns the value computed by fn or decoded
+// from the cache instead of decoding it into Item.Value.
+func OnceValue[T any](
+	ctx context.Context, c *Cache, key string, ttl time.Duration, fn func() (T, error),
+) (T, error) {
+	var value T
+	err := c.Once(&Item{
+		Ctx:   ctx,
+		Key:   key,
+		Value: &value,
+		TTL:   ttl,
+		Do: func(*Item) (interface{}, error) {
+			return fn()
+		},
+	})
+	return value, err
+}
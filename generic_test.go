@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package cache_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/cache/v8"
+)
+
+var _ = Describe("OnceValue", func() {
+	ctx := context.TODO()
+
+	It("returns the computed and the cached value", func() {
+		mycache := cache.New(&cache.Options{
+			LocalCache: cache.NewTinyLFU(100, time.Minute),
+		})
+
+		var callCount int
+		fn := func() (*Object, error) {
+			callCount++
+			return &Object{Str: "mystring", Num: 42}, nil
+		}
+
+		for i := 0; i < 2; i++ {
+			obj, err := cache.OnceValue(ctx, mycache, "key", time.Hour, fn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).To(Equal(&Object{Str: "mystring", Num: 42}))
+		}
+		Expect(callCount).To(Equal(1))
+	})
+})
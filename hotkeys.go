@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeyStat is the approximate number of Once calls for a key.
+type KeyStat struct {
+	Key   string
+	Count uint64
+}
+
+const (
+	hotKeysDepth    = 4
+	hotKeysMinWidth = 1024
+)
+
+// hotKeys counts the Once calls per key with a count-min sketch and keeps
+// the most requested keys. The counts are halved after every width*10
+// calls, so they reflect the recent calls and old keys fade out.
+type hotKeys struct {
+	mu sync.Mutex
+
+	rows    [hotKeysDepth][]uint32
+	width   uint64
+	calls   uint64
+	resetAt uint64
+
+	size int
+	top  map[string]*hotKey
+	heap hotKeyHeap
+}
+
+type hotKey struct {
+	key   string
+	count uint64
+	index int
+}
+
+// hotKeyHeap is a min-heap of the top keys by count, so the least
+// requested key is replaced in O(log size).
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	k := x.(*hotKey)
+	k.index = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+func newHotKeys(size int) *hotKeys {
+	width := 16 * size
+	if width < hotKeysMinWidth {
+		width = hotKeysMinWidth
+	}
+
+	hk := &hotKeys{
+		width:   uint64(width),
+		resetAt: 10 * uint64(width),
+		size:    size,
+		top:     make(map[string]*hotKey, size),
+		heap:    make(hotKeyHeap, 0, size),
+	}
+	for i := range hk.rows {
+		hk.rows[i] = make([]uint32, width)
+	}
+	return hk
+}
+
+func (hk *hotKeys) record(key string) {
+	h := xxhash.Sum64String(key)
+	h1, h2 := h&0xffffffff, h>>32
+
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	count := ^uint32(0)
+	for i := range hk.rows {
+		idx := (h1 + uint64(i)*h2) % hk.width
+		row := hk.rows[i]
+		if row[idx] < ^uint32(0) {
+			row[idx]++
+		}
+		if row[idx] < count {
+			count = row[idx]
+		}
+	}
+
+	hk.calls++
+	if hk.calls >= hk.resetAt {
+		hk.reset()
+		count /= 2
+	}
+
+	hk.updateTop(key, uint64(count))
+}
+
+// updateTop keeps the key if its count is larger than the count of
+// the least requested key.
+func (hk *hotKeys) updateTop(key string, count uint64) {
+	if k, ok := hk.top[key]; ok {
+		k.count = count
+		heap.Fix(&hk.heap, k.index)
+		return
+	}
+
+	if len(hk.heap) < hk.size {
+		k := &hotKey{key: key, count: count}
+		heap.Push(&hk.heap, k)
+		hk.top[key] = k
+		return
+	}
+
+	least := hk.heap[0]
+	if count > least.count {
+		delete(hk.top, least.key)
+		least.key, least.count = key, count
+		heap.Fix(&hk.heap, 0)
+		hk.top[key] = least
+	}
+}
+
+func (hk *hotKeys) reset() {
+	hk.calls = 0
+	for _, row := range hk.rows {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	// Halving keeps the order of the counts, so the heap stays valid.
+	for _, k := range hk.heap {
+		k.count /= 2
+	}
+}
+
+func (hk *hotKeys) topKeys(n int) []KeyStat {
+	hk.mu.Lock()
+	stats := make([]KeyStat, 0, len(hk.heap))
+	for _, k := range hk.heap {
+		stats = append(stats, KeyStat{Key: k.key, Count: k.count})
+	}
+	hk.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// TopKeys returns up to n keys with the most Once calls, most requested
+// first. The counts are approximate and favor recent calls. It requires
+// Options.HotKeys and returns nil otherwise.
+func (cd *Cache) TopKeys(n int) []KeyStat {
+	if cd.hotKeys == nil {
+		return nil
+	}
+	return cd.hotKeys.topKeys(n)
+}
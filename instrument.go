@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Hooks are called by the Redis client returned by InstrumentRediser.
+type Hooks struct {
+	// OnCommand is called after every command with the lowercase command
+	// name, e.g. "get" or "set", how long it took and its error. Missing
+	// keys are reported as redis.Nil. Pipelines are reported as a single
+	// "pipeline" command with the first error.
+	OnCommand func(ctx context.Context, name string, dur time.Duration, err error)
+}
+
+// InstrumentRediser wraps the Redis client used as Options.Redis, e.g.
+// a *redis.Client or *redis.Ring, and reports every command the cache
+// sends to the hooks. Any other decorator that has the same methods as
+// the client can be used as Options.Redis as well.
+func InstrumentRediser(r Rediser, hooks Hooks) Rediser {
+	return &instrumentedRediser{
+		rdb:   r,
+		hooks: hooks,
+	}
+}
+
+type instrumentedRediser struct {
+	rdb   Rediser
+	hooks Hooks
+}
+
+var _ Rediser = (*instrumentedRediser)(nil)
+
+func (r *instrumentedRediser) report(ctx context.Context, name string, start time.Time, err error) {
+	if r.hooks.OnCommand != nil {
+		r.hooks.OnCommand(ctx, name, time.Since(start), err)
+	}
+}
+
+func (r *instrumentedRediser) Set(
+	ctx context.Context, key string, value interface{}, ttl time.Duration,
+) *redis.StatusCmd {
+	start := time.Now()
+	cmd := r.rdb.Set(ctx, key, value, ttl)
+	r.report(ctx, "set", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) SetXX(
+	ctx context.Context, key string, value interface{}, ttl time.Duration,
+) *redis.BoolCmd {
+	start := time.Now()
+	cmd := r.rdb.SetXX(ctx, key, value, ttl)
+	r.report(ctx, "set", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) SetNX(
+	ctx context.Context, key string, value interface{}, ttl time.Duration,
+) *redis.BoolCmd {
+	start := time.Now()
+	cmd := r.rdb.SetNX(ctx, key, value, ttl)
+	r.report(ctx, "set", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) Get(ctx context.Context, key string) *redis.StringCmd {
+	start := time.Now()
+	cmd := r.rdb.Get(ctx, key)
+	r.report(ctx, "get", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) GetSet(ctx context.Context, key string, value interface{}) *redis.StringCmd {
+	start := time.Now()
+	cmd := r.rdb.GetSet(ctx, key, value)
+	r.report(ctx, "getset", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	start := time.Now()
+	cmd := r.rdb.Del(ctx, keys...)
+	r.report(ctx, "del", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) PExpire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	start := time.Now()
+	cmd := r.rdb.PExpire(ctx, key, ttl)
+	r.report(ctx, "pexpire", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	start := time.Now()
+	cmd := r.rdb.Exists(ctx, keys...)
+	r.report(ctx, "exists", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) StrLen(ctx context.Context, key string) *redis.IntCmd {
+	start := time.Now()
+	cmd := r.rdb.StrLen(ctx, key)
+	r.report(ctx, "strlen", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) Pipelined(
+	ctx context.Context, fn func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	start := time.Now()
+	cmds, err := r.rdb.Pipelined(ctx, fn)
+	r.report(ctx, "pipeline", start, err)
+	return cmds, err
+}
+
+func (r *instrumentedRediser) Eval(
+	ctx context.Context, script string, keys []string, args ...interface{},
+) *redis.Cmd {
+	start := time.Now()
+	cmd := r.rdb.Eval(ctx, script, keys, args...)
+	r.report(ctx, "eval", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) EvalSha(
+	ctx context.Context, sha1 string, keys []string, args ...interface{},
+) *redis.Cmd {
+	start := time.Now()
+	cmd := r.rdb.EvalSha(ctx, sha1, keys, args...)
+	r.report(ctx, "evalsha", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd {
+	start := time.Now()
+	cmd := r.rdb.ScriptExists(ctx, hashes...)
+	r.report(ctx, "script", start, cmd.Err())
+	return cmd
+}
+
+func (r *instrumentedRediser) ScriptLoad(ctx context.Context, script string) *redis.StringCmd {
+	start := time.Now()
+	cmd := r.rdb.ScriptLoad(ctx, script)
+	r.report(ctx, "script", start, cmd.Err())
+	return cmd
+}
+
+// ForEachShard calls fn for every shard of the wrapped client, if it is
+// a *redis.Ring. The commands sent to the shards are not reported.
+func (r *instrumentedRediser) ForEachShard(
+	ctx context.Context, fn func(ctx context.Context, client *redis.Client) error,
+) error {
+	rdb, ok := r.rdb.(shardIterator)
+	if !ok {
+		return fmt.Errorf("cache: %T does not support ForEachShard", r.rdb)
+	}
+	return rdb.ForEachShard(ctx, fn)
+}
+
+// ForEachMaster calls fn for every master of the wrapped client, if it is
+// a *redis.ClusterClient. The commands sent to the masters are not reported.
+func (r *instrumentedRediser) ForEachMaster(
+	ctx context.Context, fn func(ctx context.Context, client *redis.Client) error,
+) error {
+	rdb, ok := r.rdb.(masterIterator)
+	if !ok {
+		return fmt.Errorf("cache: %T does not support ForEachMaster", r.rdb)
+	}
+	return rdb.ForEachMaster(ctx, fn)
+}
+
+func (r *instrumentedRediser) Scan(
+	ctx context.Context, cursor uint64, match string, count int64,
+) *redis.ScanCmd {
+	rdb, ok := r.rdb.(scanner)
+	if !ok {
+		cmd := redis.NewScanCmd(ctx, nil)
+		cmd.SetErr(fmt.Errorf("cache: %T does not support SCAN", r.rdb))
+		return cmd
+	}
+	start := time.Now()
+	cmd := rdb.Scan(ctx, cursor, match, count)
+	r.report(ctx, "scan", start, cmd.Err())
+	return cmd
+}
+
+// PoolStats returns the pool stats of the wrapped client, if it has them.
+func (r *instrumentedRediser) PoolStats() *redis.PoolStats {
+	if pooler, ok := r.rdb.(interface {
+		PoolStats() *redis.PoolStats
+	}); ok {
+		return pooler.PoolStats()
+	}
+	return nil
+}
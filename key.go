@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"strings"
+)
+
+const keySep = ':'
+
+// Key joins the parts with ':' escaping ':' and '\' within the parts,
+// so different parts can never produce the same key:
+//
+//	cache.Key("user", "42")  // user:42
+//	cache.Key("a:b", "c")    // a\:b:c
+//	cache.Key("a", "b:c")    // a:b\:c
+func Key(parts ...string) string {
+	n := len(parts)
+	for _, part := range parts {
+		n += len(part)
+	}
+
+	var sb strings.Builder
+	sb.Grow(n)
+
+	for i, part := range parts {
+		if i > 0 {
+			sb.WriteByte(keySep)
+		}
+		for j := 0; j < len(part); j++ {
+			switch c := part[j]; c {
+			case keySep, '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+
+	return sb.String()
+}
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"encoding/binary"
+	"strings"
 	"sync"
 	"time"
 
@@ -8,22 +10,92 @@ import (
 	"golang.org/x/exp/rand"
 )
 
+// LocalCache is an in-process cache in front of Redis. The cache owns the
+// slices passed to Set, and the slices returned by Get must not be modified.
 type LocalCache interface {
 	Set(key string, data []byte)
 	Get(key string) ([]byte, bool)
 	Del(key string)
 }
 
+// ReadOrder is the order in which the local cache and Redis are checked.
+type ReadOrder uint8
+
+const (
+	// LocalFirst checks the local cache before Redis.
+	LocalFirst ReadOrder = iota
+	// RedisFirst checks Redis first and stores the value in the local
+	// cache, which Get and Once only read when Redis fails. It suits a
+	// fast Redis on the same host with a local cache that is mostly missed.
+	RedisFirst
+)
+
+// Clock tells the current time. It can be replaced in tests to check
+// expiration without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 type TinyLFU struct {
 	mu     sync.Mutex
 	rand   *rand.Rand
 	lfu    *tinylfu.T
+	size   int
 	ttl    time.Duration
 	offset time.Duration
+
+	// keys, if not nil, indexes the entries for DelPrefix. tinylfu does
+	// not report every eviction, so it may hold keys that are no longer
+	// cached until they are read or expire.
+	keys    map[string]*tinyLFUEntry
+	pruneAt int
+
+	idleTTL time.Duration
+	maxAge  time.Duration
+	clock   Clock
+
+	onEvict func(key string)
+	evicted []string
+
+	// replacing is set while Set deletes the entry it replaces,
+	// which is not reported as an eviction.
+	replacing bool
 }
 
 var _ LocalCache = (*TinyLFU)(nil)
 
+// tinyLFUEntry is stored in the tinylfu cache, which does not allow
+// changing the expiration time of an entry.
+type tinyLFUEntry struct {
+	b         []byte
+	createdAt time.Time
+	expireAt  time.Time
+
+	// maxExpireAt, if not zero, is the bound set by the max age,
+	// which idle expiration can't extend.
+	maxExpireAt time.Time
+}
+
+func (e *tinyLFUEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+func (e *tinyLFUEntry) capExpireAt(expireAt time.Time) time.Time {
+	if !e.maxExpireAt.IsZero() && (expireAt.IsZero() || expireAt.After(e.maxExpireAt)) {
+		return e.maxExpireAt
+	}
+	return expireAt
+}
+
+// NewTinyLFU returns a local cache that holds up to size entries for the
+// given ttl. A negative ttl disables local expiration, which is useful when
+// entries are invalidated by other means, e.g. pub/sub.
 func NewTinyLFU(size int, ttl time.Duration) *TinyLFU {
 	const maxOffset = 10 * time.Second
 
@@ -31,51 +103,546 @@ func NewTinyLFU(size int, ttl time.Duration) *TinyLFU {
 	if offset > maxOffset {
 		offset = maxOffset
 	}
+	if offset < 0 {
+		offset = 0
+	}
 
 	return &TinyLFU{
 		rand:   rand.New(rand.NewSource(uint64(time.Now().UnixNano()))),
 		lfu:    tinylfu.New(size, 100000),
+		size:   size,
 		ttl:    ttl,
 		offset: offset,
+		clock:  realClock{},
 	}
 }
 
+// TTL returns the ttl the cache was created with.
+func (c *TinyLFU) TTL() time.Duration {
+	return c.ttl
+}
+
 func (c *TinyLFU) UseRandomizedTTL(offset time.Duration) {
 	c.offset = offset
 }
 
-func (c *TinyLFU) Set(key string, b []byte) {
+// SetIdleTTL makes entries expire when they are not read for the given ttl
+// instead of the ttl since they were set, so frequently read entries stay
+// in the cache. Zero restores the ttl since the entry was set.
+func (c *TinyLFU) SetIdleTTL(ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	ttl := c.ttl
-	if c.offset > 0 {
-		ttl += time.Duration(c.rand.Int63n(int64(c.offset)))
+	c.idleTTL = ttl
+}
+
+// SetMaxAge makes entries expire when they were set longer than the given
+// age ago, regardless of the ttl and idle ttl, and hides them from GetStale.
+// Zero removes the limit. It applies to the entries set afterwards.
+func (c *TinyLFU) SetMaxAge(age time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxAge = age
+}
+
+// SetKeyIndex makes the cache index the keys of the entries set afterwards,
+// which DelPrefix requires. The index costs memory and time on every Set,
+// so it is disabled by default. Disabling it drops the index.
+func (c *TinyLFU) SetKeyIndex(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case !enabled:
+		c.keys = nil
+	case c.keys == nil:
+		c.keys = make(map[string]*tinyLFUEntry)
+		c.pruneAt = 2 * c.size
 	}
+}
+
+// SetClock replaces the clock used for expiration.
+func (c *TinyLFU) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.lfu.Set(&tinylfu.Item{
-		Key:      key,
-		Value:    b,
-		ExpireAt: time.Now().Add(ttl),
-	})
+	c.clock = clock
 }
 
-func (c *TinyLFU) Get(key string) ([]byte, bool) {
+// SetOnEvict sets a func that is called with the key of an entry that
+// leaves the cache, either because it was evicted or deleted. Expired
+// entries are kept for GetStale until they are evicted. The func is called
+// after the cache is unlocked, so it may use the cache.
+//
+// It is best effort: tinylfu does not report the entries it drops from its
+// main segment to admit a more frequently used one, and entries stored
+// before the func is set may not be reported.
+func (c *TinyLFU) SetOnEvict(fn func(key string)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.onEvict = fn
+}
+
+// unlock unlocks the cache and reports the entries that were evicted
+// while it was locked.
+func (c *TinyLFU) unlock() {
+	onEvict := c.onEvict
+	evicted := c.evicted
+	c.evicted = nil
+	c.mu.Unlock()
+
+	for _, key := range evicted {
+		onEvict(key)
+	}
+}
+
+func (c *TinyLFU) Set(key string, b []byte) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.set(key, b)
+}
+
+// SetMany is like calling Set for every key and value, but locks the cache
+// once, which reduces contention when many entries are set together, e.g.
+// when a batch read from Redis is stored in the local cache.
+func (c *TinyLFU) SetMany(keys []string, values [][]byte) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	for i, key := range keys {
+		c.set(key, values[i])
+	}
+}
+
+func (c *TinyLFU) set(key string, b []byte) {
+	now := c.clock.Now()
+	entry := &tinyLFUEntry{
+		b:         b,
+		createdAt: now,
+	}
+	if c.maxAge > 0 {
+		entry.maxExpireAt = now.Add(c.maxAge)
+	}
+	entry.expireAt = entry.capExpireAt(c.expireAt(now))
+
+	// tinylfu does not replace existing entries, so delete the old one.
+	// Del is used instead of Get, which would count as an access.
+	c.replacing = true
+	c.lfu.Del(key)
+	c.replacing = false
+
+	item := &tinylfu.Item{
+		Key:   key,
+		Value: entry,
+	}
+	if c.onEvict != nil || c.keys != nil {
+		item.OnEvict = func() {
+			c.evict(key, entry)
+		}
+	}
+	c.lfu.Set(item)
+
+	if c.keys != nil {
+		c.keys[key] = entry
+		if len(c.keys) > c.pruneAt {
+			c.pruneKeys(now)
+		}
+	}
+}
+
+// expireAt returns the expiration time of an entry set or touched at now.
+func (c *TinyLFU) expireAt(now time.Time) time.Time {
+	switch {
+	case c.idleTTL > 0:
+		return now.Add(c.idleTTL)
+	case c.ttl >= 0:
+		ttl := c.ttl
+		if c.offset > 0 {
+			ttl += time.Duration(c.rand.Int63n(int64(c.offset)))
+		}
+		return now.Add(ttl)
+	}
+	return time.Time{}
+}
+
+// evict is called by tinylfu when the entry leaves the cache.
+func (c *TinyLFU) evict(key string, entry *tinyLFUEntry) {
+	if c.replacing {
+		return
+	}
+	if c.keys[key] == entry {
+		delete(c.keys, key)
+	}
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, key)
+	}
+}
+
+// pruneKeys deletes the expired entries to remove the keys that tinylfu
+// dropped without reporting them from the index. It does not use Get,
+// which would count as an access.
+func (c *TinyLFU) pruneKeys(now time.Time) {
+	for key, entry := range c.keys {
+		if entry.expired(now) {
+			c.lfu.Del(key)
+			delete(c.keys, key)
+		}
+	}
+
+	c.pruneAt = 2 * len(c.keys)
+	if c.pruneAt < 2*c.size {
+		c.pruneAt = 2 * c.size
+	}
+}
+
+func (c *TinyLFU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+
 	val, ok := c.lfu.Get(key)
 	if !ok {
+		delete(c.keys, key)
 		return nil, false
 	}
 
-	b := val.([]byte)
-	return b, true
+	entry := val.(*tinyLFUEntry)
+	if !entry.expireAt.IsZero() {
+		now := c.clock.Now()
+		if entry.expired(now) {
+			return nil, false
+		}
+		if c.idleTTL > 0 {
+			entry.expireAt = entry.capExpireAt(now.Add(c.idleTTL))
+		}
+	}
+	return entry.b, true
+}
+
+// Touch restarts the TTL of the entry as if it was set again, but keeps
+// the time it was set, so the max age still applies. It reports whether
+// the entry is in the cache and not expired.
+func (c *TinyLFU) Touch(key string) bool {
+	c.mu.Lock()
+	defer c.unlock()
+
+	val, ok := c.lfu.Get(key)
+	if !ok {
+		delete(c.keys, key)
+		return false
+	}
+
+	entry := val.(*tinyLFUEntry)
+	now := c.clock.Now()
+	if entry.expired(now) {
+		return false
+	}
+	entry.expireAt = entry.capExpireAt(c.expireAt(now))
+	return true
+}
+
+// Age returns how long ago the entry was set and whether it is in the cache
+// and not expired.
+func (c *TinyLFU) Age(key string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	val, ok := c.lfu.Get(key)
+	if !ok {
+		delete(c.keys, key)
+		return 0, false
+	}
+
+	entry := val.(*tinyLFUEntry)
+	now := c.clock.Now()
+	if entry.expired(now) {
+		return 0, false
+	}
+	return now.Sub(entry.createdAt), true
+}
+
+// GetStale is like Get, but also returns expired entries that are still
+// in the cache.
+func (c *TinyLFU) GetStale(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	val, ok := c.lfu.Get(key)
+	if !ok {
+		delete(c.keys, key)
+		return nil, false
+	}
+
+	entry := val.(*tinyLFUEntry)
+	if !entry.maxExpireAt.IsZero() && !c.clock.Now().Before(entry.maxExpireAt) {
+		return nil, false
+	}
+	return entry.b, true
 }
 
 func (c *TinyLFU) Del(key string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	c.lfu.Del(key)
+	delete(c.keys, key)
+}
+
+// DelPrefix deletes the entries with keys that start with the prefix.
+// It requires SetKeyIndex and deletes nothing otherwise.
+func (c *TinyLFU) DelPrefix(prefix string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	for key := range c.keys {
+		if strings.HasPrefix(key, prefix) {
+			c.lfu.Del(key)
+			delete(c.keys, key)
+		}
+	}
+}
+
+// Tiered is a local cache that chains several local caches, e.g. a small
+// fast cache in front of a larger one. Get checks the tiers in order and
+// copies a hit into the tiers before it, Set and Del apply to all tiers.
+//
+// The clock, idle TTL, max age, key index, SetMany and DelPrefix are passed
+// to the tiers that support them. GetStale and Age use the first tier that
+// has the entry. Evictions are reported by the last tier only, because an
+// entry leaves the upper tiers while it is still cached in the lower ones.
+type Tiered struct {
+	tiers []LocalCache
+}
+
+var _ LocalCache = (*Tiered)(nil)
+
+// NewTiered returns a local cache that uses the tiers in the given order.
+func NewTiered(tiers ...LocalCache) *Tiered {
+	return &Tiered{
+		tiers: tiers,
+	}
+}
+
+func (c *Tiered) Set(key string, b []byte) {
+	for _, tier := range c.tiers {
+		tier.Set(key, b)
+	}
+}
+
+func (c *Tiered) Get(key string) ([]byte, bool) {
+	for i, tier := range c.tiers {
+		b, ok := tier.Get(key)
+		if !ok {
+			continue
+		}
+
+		for _, upper := range c.tiers[:i] {
+			upper.Set(key, b)
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+func (c *Tiered) Del(key string) {
+	for _, tier := range c.tiers {
+		tier.Del(key)
+	}
+}
+
+func (c *Tiered) SetMany(keys []string, values [][]byte) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(manySetter); ok {
+			tier.SetMany(keys, values)
+			continue
+		}
+		for i, key := range keys {
+			tier.Set(key, values[i])
+		}
+	}
+}
+
+func (c *Tiered) DelPrefix(prefix string) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(prefixDeleter); ok {
+			tier.DelPrefix(prefix)
+		}
+	}
+}
+
+func (c *Tiered) GetStale(key string) ([]byte, bool) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(staleGetter); ok {
+			if b, ok := tier.GetStale(key); ok {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (c *Tiered) Age(key string) (time.Duration, bool) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(ager); ok {
+			if age, ok := tier.Age(key); ok {
+				return age, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c *Tiered) Touch(key string) bool {
+	var touched bool
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(toucher); ok {
+			touched = tier.Touch(key) || touched
+			continue
+		}
+		if b, ok := tier.Get(key); ok {
+			tier.Set(key, b)
+			touched = true
+		}
+	}
+	return touched
+}
+
+func (c *Tiered) SetClock(clock Clock) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(clockSetter); ok {
+			tier.SetClock(clock)
+		}
+	}
+}
+
+func (c *Tiered) SetIdleTTL(ttl time.Duration) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(idleTTLSetter); ok {
+			tier.SetIdleTTL(ttl)
+		}
+	}
+}
+
+func (c *Tiered) SetMaxAge(age time.Duration) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(maxAgeSetter); ok {
+			tier.SetMaxAge(age)
+		}
+	}
+}
+
+func (c *Tiered) SetKeyIndex(enabled bool) {
+	for _, tier := range c.tiers {
+		if tier, ok := tier.(keyIndexSetter); ok {
+			tier.SetKeyIndex(enabled)
+		}
+	}
+}
+
+func (c *Tiered) SetOnEvict(fn func(key string)) {
+	if len(c.tiers) == 0 {
+		return
+	}
+	if tier, ok := c.tiers[len(c.tiers)-1].(evictNotifier); ok {
+		tier.SetOnEvict(fn)
+	}
+}
+
+// keyedLocalCache prefixes every entry with the key it was stored for, so an
+// entry returned for a colliding key is detected and treated as a miss.
+type keyedLocalCache struct {
+	LocalCache
+}
+
+func (c *keyedLocalCache) Set(key string, data []byte) {
+	c.LocalCache.Set(key, withKey(key, data))
+}
+
+func (c *keyedLocalCache) Get(key string) ([]byte, bool) {
+	b, ok := c.LocalCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return stripKey(key, b)
+}
+
+func (c *keyedLocalCache) GetStale(key string) ([]byte, bool) {
+	local, ok := c.LocalCache.(staleGetter)
+	if !ok {
+		return nil, false
+	}
+
+	b, ok := local.GetStale(key)
+	if !ok {
+		return nil, false
+	}
+	return stripKey(key, b)
+}
+
+func (c *keyedLocalCache) Age(key string) (time.Duration, bool) {
+	if _, ok := c.Get(key); !ok {
+		return 0, false
+	}
+
+	local, ok := c.LocalCache.(ager)
+	if !ok {
+		return 0, false
+	}
+	return local.Age(key)
+}
+
+func (c *keyedLocalCache) Touch(key string) bool {
+	b, ok := c.LocalCache.Get(key)
+	if !ok {
+		return false
+	}
+	if _, ok := stripKey(key, b); !ok {
+		return false
+	}
+
+	if local, ok := c.LocalCache.(toucher); ok {
+		return local.Touch(key)
+	}
+	c.LocalCache.Set(key, b)
+	return true
+}
+
+func (c *keyedLocalCache) SetMany(keys []string, values [][]byte) {
+	local, ok := c.LocalCache.(manySetter)
+	if !ok {
+		for i, key := range keys {
+			c.Set(key, values[i])
+		}
+		return
+	}
+
+	keyed := make([][]byte, len(values))
+	for i, key := range keys {
+		keyed[i] = withKey(key, values[i])
+	}
+	local.SetMany(keys, keyed)
+}
+
+func (c *keyedLocalCache) DelPrefix(prefix string) {
+	if local, ok := c.LocalCache.(prefixDeleter); ok {
+		local.DelPrefix(prefix)
+	}
+}
+
+func withKey(key string, data []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen64+len(key)+len(data))
+	n := binary.PutUvarint(b, uint64(len(key)))
+	n += copy(b[n:], key)
+	n += copy(b[n:], data)
+	return b[:n]
+}
+
+func stripKey(key string, b []byte) ([]byte, bool) {
+	keyLen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < keyLen || string(b[n:n+int(keyLen)]) != key {
+		return nil, false
+	}
+	return b[n+int(keyLen):], true
 }
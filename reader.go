@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// SetReader caches the data read from r as is, like a byte slice, but
+// without the copy Set makes of it. Redis strings can't be written in
+// chunks, so the data is still read into memory. Use Options.MaxLocalSize
+// to keep large values out of the local cache.
+func (cd *Cache) SetReader(ctx context.Context, key string, r io.Reader, ttl time.Duration) error {
+	if cd.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := cd.checkKey(key); err != nil {
+		return err
+	}
+	if err := cd.checkTTL(key, ttl); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return cd.setBytes(&Item{
+		Ctx: ctx,
+		Key: key,
+		TTL: ttl,
+	}, escapeRaw(b))
+}
+
+// GetReader returns a reader of the value for the given key as it is
+// stored, e.g. by SetReader, without decoding or copying it.
+func (cd *Cache) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := cd.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	b, err := cd.getBytes(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(unescapeRaw(b))), nil
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"github.com/cespare/xxhash/v2"
+)
+
+// ShardFunc returns the index of the Redis shard that owns the key.
+type ShardFunc func(key string, numShards int) int
+
+// JumpHash is the default ShardFunc. It uses jump consistent hashing, so
+// adding a shard only moves about 1/n of the keys.
+func JumpHash(key string, numShards int) int {
+	h := xxhash.Sum64String(key)
+
+	var b, j int64 = -1, 0
+	for j < int64(numShards) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return int(b)
+}
+
+// redis returns the Redis client that owns the key or nil if Redis is not
+// configured.
+func (cd *Cache) redis(key string) Rediser {
+	if len(cd.shards) == 0 {
+		return nil
+	}
+	return cd.shards[cd.shardIndex(key)]
+}
+
+func (cd *Cache) shardIndex(key string) int {
+	if len(cd.shards) == 1 {
+		return 0
+	}
+	return cd.shardFunc(key, len(cd.shards))
+}
+
+// groupByShard groups the indexes of the keys by the index of the shard
+// that owns them.
+func (cd *Cache) groupByShard(keys []string) [][]int {
+	groups := make([][]int, len(cd.shards))
+	for i, key := range keys {
+		shard := cd.shardIndex(key)
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
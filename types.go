@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var types struct {
+	mu     sync.RWMutex
+	names  map[reflect.Type]string
+	newFns map[string]func() interface{}
+}
+
+// RegisterType registers a type for polymorphic values. Values of the type,
+// or pointers to it, are stored with the name, and Get into *interface{}
+// decodes them into the value returned by newFn, which must be a pointer.
+// Like gob.Register, it is meant to be called from init and panics if the
+// name or the type is already registered.
+func RegisterType(name string, newFn func() interface{}) {
+	typ := reflect.TypeOf(newFn())
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		panic(fmt.Errorf("cache: RegisterType(%q): newFn must return a pointer, got %v", name, typ))
+	}
+
+	types.mu.Lock()
+	defer types.mu.Unlock()
+
+	if _, ok := types.newFns[name]; ok {
+		panic(fmt.Errorf("cache: RegisterType(%q): name is already registered", name))
+	}
+	for _, t := range []reflect.Type{typ, typ.Elem()} {
+		if other, ok := types.names[t]; ok {
+			panic(fmt.Errorf("cache: RegisterType(%q): %v is already registered as %q", name, t, other))
+		}
+	}
+
+	if types.names == nil {
+		types.names = make(map[reflect.Type]string)
+		types.newFns = make(map[string]func() interface{})
+	}
+	types.names[typ] = name
+	types.names[typ.Elem()] = name
+	types.newFns[name] = newFn
+}
+
+func registeredName(value interface{}) (string, bool) {
+	types.mu.RLock()
+	defer types.mu.RUnlock()
+
+	name, ok := types.names[reflect.TypeOf(value)]
+	return name, ok
+}
+
+func registeredNew(name string) (interface{}, error) {
+	types.mu.RLock()
+	newFn, ok := types.newFns[name]
+	types.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("cache: type %q is not registered", name)
+	}
+	return newFn(), nil
+}
+
+// appendTypeName appends a type name in the form that precedes the msgpack
+// payload of typed values.
+func appendTypeName(b []byte, name string) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(name)))
+	b = append(b, buf[:n]...)
+	return append(b, name...)
+}
+
+// unmarshalTyped decodes a typed value. Into *interface{} it decodes into
+// a new value of the registered type, and otherwise it ignores the name.
+func unmarshalTyped(b []byte, value interface{}) error {
+	nameLen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < nameLen {
+		return errors.New("cache: invalid type name")
+	}
+	name := string(b[n : n+int(nameLen)])
+	b = b[n+int(nameLen):]
+
+	dst, ok := value.(*interface{})
+	if !ok {
+		return unmarshalMsgpack(b, value)
+	}
+
+	v, err := registeredNew(name)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalMsgpack(b, v); err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+// marshalError encodes an error returned by Do, so it can be cached and
+// returned again on a hit. It reports false unless the error is a
+// registered type.
+func (cd *Cache) marshalError(item *Item, doErr error) ([]byte, bool) {
+	if _, ok := registeredName(doErr); !ok {
+		return nil, false
+	}
+
+	b, err := cd.marshalCompress(doErr, item.Compress)
+	if err != nil {
+		return nil, false
+	}
+	// Types that implement a marshaler interface are not typed.
+	if h, _, ok := parseHeader(b); !ok || h.encoding != typedEncoding {
+		return nil, false
+	}
+	b[3] |= errorFlag
+
+	if item.Version != 0 {
+		b = setVersion(b, item.Version)
+	}
+	return b, true
+}
+
+// cachedError returns the error stored by marshalError or nil if the value
+// is not an error.
+func (cd *Cache) cachedError(b []byte) error {
+	h, _, ok := parseHeader(b)
+	if !ok || h.flags&errorFlag == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := cd._unmarshal(b, &v); err != nil {
+		return err
+	}
+	err, ok := v.(error)
+	if !ok {
+		return fmt.Errorf("cache: cached error %T does not implement error", v)
+	}
+	return err
+}